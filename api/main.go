@@ -1,5 +1,179 @@
 package main
 
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tommenx/csi-lvm-plugin/pkg/lvm"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+var (
+	listen   = flag.String("listen", "127.0.0.1:8089", "address of the management api")
+	vgFilter = lvm.AddVGFilterFlags(flag.CommandLine)
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+// local management api of the lvm plugin
+// it only reads the state, the volumes are changed through the csi driver
 func main() {
+	flag.Parse()
+	s := &apiServer{exec: mount.NewOsExec(), loadAllocations: lvm.LoadAllocations}
+	// the api reports the same vg as the driver
+	if err := vgFilter.Apply(s.exec); err != nil {
+		glog.Fatalf("invalid vg filter, %v", err)
+	}
+	glog.Infof("management api listens on %s", *listen)
+	if err := http.ListenAndServe(*listen, s.routes()); err != nil {
+		glog.Fatalf("management api stopped, %v", err)
+	}
+}
+
+// apiServer serves the api, the lvm commands run through exec
+type apiServer struct {
+	exec mount.Exec
+	// reads the volumes from the journal of the driver
+	loadAllocations func() (lvm.AllocationsLVM, error)
+}
+
+func (s *apiServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vgs", s.handleVGs)
+	mux.HandleFunc("/volumes", s.handleVolumes)
+	mux.HandleFunc("/volumes/", s.handleVolume)
+	mux.HandleFunc("/limits", s.handleLimits)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	return mux
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type volumeLimits struct {
+	VolID   string      `json:"vol_id"`
+	VolName string      `json:"vol_name"`
+	Limits  interface{} `json:"io_limits"`
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		glog.Errorf("write response error, %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+// only GET is served
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return false
+	}
+	return true
+}
+
+// GET /vgs
+func (s *apiServer) handleVGs(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	node, err := lvm.GetNodeInfo(s.exec)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, node)
+}
+
+// GET /volumes
+func (s *apiServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	allocation, err := s.loadAllocations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, allocation)
+}
+
+// GET /volumes/<vol_id>
+func (s *apiServer) handleVolume(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	allocation, err := s.loadAllocations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, vol := range allocation.Allocation {
+		if vol.VolID == id || vol.VolName == id {
+			writeJSON(w, http.StatusOK, vol)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, errorResponse{Error: "volume not found"})
+}
+
+// GET /limits
+func (s *apiServer) handleLimits(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	allocation, err := s.loadAllocations()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	limits := []volumeLimits{}
+	for _, vol := range allocation.Allocation {
+		limits = append(limits, volumeLimits{VolID: vol.VolID, VolName: vol.VolName, Limits: vol.Limits})
+	}
+	writeJSON(w, http.StatusOK, limits)
+}
 
+// GET /healthz
+// lvm must answer and the journal of the driver must be readable
+func (s *apiServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	resp := healthResponse{Status: "ok", Checks: map[string]string{}}
+	if _, err := lvm.GetNodeInfo(s.exec); err != nil {
+		resp.Status = "unhealthy"
+		resp.Checks["lvm"] = err.Error()
+	} else {
+		resp.Checks["lvm"] = "ok"
+	}
+	if _, err := s.loadAllocations(); err != nil {
+		resp.Status = "unhealthy"
+		resp.Checks["state"] = err.Error()
+	} else {
+		resp.Checks["state"] = "ok"
+	}
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, resp)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tommenx/csi-lvm-plugin/pkg/lvm"
+)
+
+// fakeExec answers the reports of lvm with the vg of the node
+type fakeExec struct {
+	vgs string
+	err error
+}
+
+func (f *fakeExec) Run(cmd string, args ...string) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	switch cmd {
+	case "vgs":
+		return []byte(f.vgs), nil
+	case "lvs":
+		return []byte(`{"report": [{"lv": []}]}`), nil
+	}
+	return nil, fmt.Errorf("unexpected command %s", cmd)
+}
+
+const testVGs = `{"report": [{"vg": [
+	{"vg_name": "vgdata", "vg_size": "10737418240", "vg_free": "8589934592"},
+	{"vg_name": "system", "vg_size": "2147483648", "vg_free": "0"}]}]}`
+
+const testAllocations = `{"allocation": [
+	{"vol_id": "id-1", "vol_name": "pvc-1", "volume_group": "vgdata", "volume_size": 1073741824, "io_limits": {"write_bps": 1048576}},
+	{"vol_id": "id-2", "vol_name": "pvc-2", "volume_group": "vgdata", "volume_size": 2147483648}]}`
+
+func newTestServer(t *testing.T) (*apiServer, *fakeExec) {
+	allocation := lvm.AllocationsLVM{}
+	if err := json.Unmarshal([]byte(testAllocations), &allocation); err != nil {
+		t.Fatal(err)
+	}
+	exec := &fakeExec{vgs: testVGs}
+	return &apiServer{
+		exec:            exec,
+		loadAllocations: func() (lvm.AllocationsLVM, error) { return allocation, nil },
+	}, exec
+}
+
+func get(t *testing.T, s *apiServer, method, path string, data interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, req)
+	if data != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), data); err != nil {
+			t.Fatalf("%s %s: invalid response %q, %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestHandleVGs(t *testing.T) {
+	s, exec := newTestServer(t)
+	if err := lvm.SetVGFilter(nil, []string{"system"}); err != nil {
+		t.Fatal(err)
+	}
+	defer lvm.SetVGFilter(nil, nil)
+
+	node := &lvm.NodeLVMInfo{}
+	if code := get(t, s, http.MethodGet, "/vgs", node); code != http.StatusOK {
+		t.Fatalf("GET /vgs expect 200, got %d", code)
+	}
+	if len(node.Report) != 1 || len(node.Report[0].Vg) != 1 || node.Report[0].Vg[0].VgName != "vgdata" {
+		t.Errorf("expect only vg vgdata, got %+v", node)
+	}
+	if code := get(t, s, http.MethodPost, "/vgs", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /vgs expect 405, got %d", code)
+	}
+	exec.err = fmt.Errorf("lvm is gone")
+	resp := &errorResponse{}
+	if code := get(t, s, http.MethodGet, "/vgs", resp); code != http.StatusInternalServerError || !strings.Contains(resp.Error, "lvm is gone") {
+		t.Errorf("GET /vgs of failed lvm expect 500, got %d %+v", code, resp)
+	}
+}
+
+func TestHandleVolumes(t *testing.T) {
+	s, _ := newTestServer(t)
+	allocation := &lvm.AllocationsLVM{}
+	if code := get(t, s, http.MethodGet, "/volumes", allocation); code != http.StatusOK || len(allocation.Allocation) != 2 {
+		t.Errorf("GET /volumes expect 2 volumes, got %d %+v", code, allocation)
+	}
+	for _, id := range []string{"id-2", "pvc-2"} {
+		vol := map[string]interface{}{}
+		if code := get(t, s, http.MethodGet, "/volumes/"+id, &vol); code != http.StatusOK || vol["vol_id"] != "id-2" {
+			t.Errorf("GET /volumes/%s expect volume id-2, got %d %+v", id, code, vol)
+		}
+	}
+	if code := get(t, s, http.MethodGet, "/volumes/id-3", &errorResponse{}); code != http.StatusNotFound {
+		t.Errorf("GET /volumes/id-3 expect 404, got %d", code)
+	}
+
+	s.loadAllocations = func() (lvm.AllocationsLVM, error) { return lvm.AllocationsLVM{}, fmt.Errorf("bad journal") }
+	if code := get(t, s, http.MethodGet, "/volumes", &errorResponse{}); code != http.StatusInternalServerError {
+		t.Errorf("GET /volumes of bad journal expect 500, got %d", code)
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	s, _ := newTestServer(t)
+	limits := []struct {
+		VolID  string `json:"vol_id"`
+		Limits struct {
+			WriteBps uint64 `json:"write_bps"`
+		} `json:"io_limits"`
+	}{}
+	if code := get(t, s, http.MethodGet, "/limits", &limits); code != http.StatusOK {
+		t.Fatalf("GET /limits expect 200, got %d", code)
+	}
+	if len(limits) != 2 || limits[0].VolID != "id-1" || limits[0].Limits.WriteBps != 1048576 || limits[1].Limits.WriteBps != 0 {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	s, exec := newTestServer(t)
+	resp := &healthResponse{}
+	if code := get(t, s, http.MethodGet, "/healthz", resp); code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("GET /healthz expect ok, got %d %+v", code, resp)
+	}
+	exec.err = fmt.Errorf("lvm is gone")
+	resp = &healthResponse{}
+	if code := get(t, s, http.MethodGet, "/healthz", resp); code != http.StatusServiceUnavailable || !strings.Contains(resp.Checks["lvm"], "lvm is gone") {
+		t.Errorf("GET /healthz of failed lvm expect 503, got %d %+v", code, resp)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tommenx/csi-lvm-plugin/pkg/lvm"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+var (
+	kubeconfig = flag.String("kubeconfig", "", "kubeconfig to look up the pvc of the volumes, skipped if empty")
+	vgFilter   = lvm.AddVGFilterFlags(flag.CommandLine)
+	output     = flag.String("o", "table", "output format, table or json")
+	// runs the lvm commands
+	osExec = mount.NewOsExec()
+)
+
+const usage = `lvmctl inspects the volumes of the lvm plugin on this node
+
+usage: lvmctl [flags] <command> [args]
+
+commands:
+  volumes                 list the volumes created by the driver
+  vgs                     show the capacity of the volume groups
+  pvs                     show the physical volumes of the volume groups
+  limits [vol_id]         show the io limits of the volumes
+  orphans                 compare the lv on the disk with the journal of the driver
+  force-delete <vol_id>   remove the lv and the journal entry of a volume, the driver must be stopped
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := vgFilter.Apply(osExec); err != nil {
+		fatal(err)
+	}
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "volumes":
+		err = listVolumes()
+	case "vgs":
+		err = listVGs()
+	case "pvs":
+		err = listPVs()
+	case "limits":
+		err = showLimits(args)
+	case "orphans":
+		err = showOrphans()
+	case "force-delete":
+		if len(args) != 1 {
+			fatal(fmt.Errorf("force-delete needs a volume id"))
+		}
+		err = lvm.ForceDeleteVolume(osExec, args[0])
+		if err == nil {
+			fmt.Printf("volume %s deleted\n", args[0])
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func listVolumes() error {
+	vols, err := lvm.ListDriverVolumes(osExec)
+	if err != nil {
+		return err
+	}
+	pvcs := pvcNames()
+	if *output == "json" {
+		// the records of the volumes with the pvc added, if it is known
+		records := []map[string]interface{}{}
+		for _, vol := range vols {
+			data, err := json.Marshal(vol)
+			if err != nil {
+				return err
+			}
+			record := map[string]interface{}{}
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if pvc, ok := pvcs[vol.VolName]; ok {
+				record["pvc"] = pvc
+			}
+			records = append(records, record)
+		}
+		return printJSON(records)
+	}
+	w := newTable("VOL_ID", "VOL_NAME", "PVC", "VG", "LV", "THIN_POOL", "SIZE", "DEVICE")
+	for _, vol := range vols {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s:%s\n", vol.VolID, vol.VolName, orNone(pvcs[vol.VolName]),
+			vol.VolumeGroup, vol.LvmName, orNone(vol.ThinPool), vol.VolSize, vol.Maj, vol.Min)
+	}
+	return w.Flush()
+}
+
+func listVGs() error {
+	node, err := lvm.GetNodeInfo(osExec)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(node)
+	}
+	w := newTable("VG", "SIZE", "FREE", "TAGS")
+	for _, vg := range node.Report {
+		for _, v := range vg.Vg {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.VgName, v.VgSize, v.VgFree, orNone(v.VgTags))
+		}
+	}
+	return w.Flush()
+}
+
+func listPVs() error {
+	pvs, err := lvm.ListPVs(osExec)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(pvs)
+	}
+	w := newTable("PV", "VG", "SIZE", "FREE", "ATTR")
+	for _, pv := range pvs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pv.PvName, pv.VgName, pv.PvSize, pv.PvFree, pv.PvAttr)
+	}
+	return w.Flush()
+}
+
+func showLimits(args []string) error {
+	vols, err := lvm.ListDriverVolumes(osExec)
+	if err != nil {
+		return err
+	}
+	type limits struct {
+		VolID   string            `json:"vol_id"`
+		VolName string            `json:"vol_name"`
+		Tagged  interface{}       `json:"io_limits"`
+		Cgroup  map[string]string `json:"cgroup"`
+		index   int
+	}
+	all := []limits{}
+	for i := range vols {
+		vol := &vols[i]
+		if len(args) != 0 && vol.VolID != args[0] && vol.VolName != args[0] {
+			continue
+		}
+		cgroup, err := lvm.CgroupLimits(vol)
+		if err != nil {
+			return err
+		}
+		all = append(all, limits{VolID: vol.VolID, VolName: vol.VolName, Tagged: vol.Limits, Cgroup: cgroup, index: i})
+	}
+	if len(args) != 0 && len(all) == 0 {
+		return fmt.Errorf("can't find volume %s", args[0])
+	}
+	if *output == "json" {
+		return printJSON(all)
+	}
+	w := newTable("VOL_ID", "VOL_NAME", "READ_BPS", "WRITE_BPS", "READ_IOPS", "WRITE_IOPS", "CGROUP")
+	for _, l := range all {
+		vol := vols[l.index]
+		cgroup := []string{}
+		for f, v := range l.Cgroup {
+			if len(v) != 0 {
+				cgroup = append(cgroup, fmt.Sprintf("%s=%s", f, strings.Replace(v, "\n", ",", -1)))
+			}
+		}
+		sort.Strings(cgroup)
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", l.VolID, l.VolName, vol.Limits.ReadBps, vol.Limits.WriteBps,
+			vol.Limits.ReadIops, vol.Limits.WriteIops, orNone(strings.Join(cgroup, " ")))
+	}
+	return w.Flush()
+}
+
+func showOrphans() error {
+	report, err := lvm.FindOrphans(osExec)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(report)
+	}
+	w := newTable("VOL_ID", "PROBLEM")
+	for _, id := range report.Unknown {
+		fmt.Fprintf(w, "%s\tlv is not in the journal\n", id)
+	}
+	for _, id := range report.Missing {
+		fmt.Fprintf(w, "%s\tlv is missing\n", id)
+	}
+	return w.Flush()
+}
+
+// the pvc of the volumes, empty if no kubeconfig is given
+func pvcNames() map[string]string {
+	if len(*kubeconfig) == 0 {
+		return map[string]string{}
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		fatal(err)
+	}
+	client, err := k8s.NewForConfig(cfg)
+	if err != nil {
+		fatal(err)
+	}
+	names, err := lvm.PVCNames(client)
+	if err != nil {
+		fatal(err)
+	}
+	return names
+}
+
+func newTable(headers ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	return w
+}
+
+func printJSON(data interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+func orNone(str string) string {
+	if len(str) == 0 {
+		return "<none>"
+	}
+	return str
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "lvmctl: %v\n", err)
+	os.Exit(1)
+}
@@ -27,6 +27,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/tommenx/csi-lvm-plugin/pkg/lvm"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 func init() {
@@ -42,6 +43,9 @@ const (
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeId   = flag.String("nodeid", "", "node id")
+	vgFilter = lvm.AddVGFilterFlags(flag.CommandLine)
+	lvPrefix = flag.String("lv-prefix", lvm.GetEnv("LV_PREFIX", "csi-"), "prefix of the lv names, which end with the volume id")
+	ratios   = flag.String("overprovision-ratios", os.Getenv("OVERPROVISION_RATIOS"), "comma separated vg/pool=ratio, the virtual size of a thin pool can not exceed its size * ratio")
 )
 
 func init() {
@@ -52,10 +56,22 @@ func init() {
 func main() {
 	flag.Parse()
 	drivername := "lvmplugin.csi.alibabacloud.com"
-	log.Infof("CSI Driver: ", drivername, *nodeId, *endpoint)
+	log.Infof("CSI Driver: %s, node: %s, endpoint: %s", drivername, *nodeId, *endpoint)
+	if err := vgFilter.Apply(mount.NewOsExec()); err != nil {
+		glog.Errorf("invalid vg filter, %v", err)
+		os.Exit(1)
+	}
+	if err := lvm.SetLVPrefix(*lvPrefix); err != nil {
+		glog.Errorf("invalid lv prefix, %v", err)
+		os.Exit(1)
+	}
+	if err := lvm.SetOverProvisionRatios(lvm.SplitList(*ratios)); err != nil {
+		glog.Errorf("invalid overprovisioning ratios, %v", err)
+		os.Exit(1)
+	}
 	k8sCache := lvm.NewConfigCache()
 	driver := lvm.NewDriver(*nodeId, *endpoint, k8sCache)
-	lvmNodeInfo, err := lvm.GetNodeInfo()
+	lvmNodeInfo, err := lvm.GetNodeInfo(mount.NewOsExec())
 	if err != nil {
 		glog.Error("can't get node info ")
 	}
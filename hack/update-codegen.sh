@@ -0,0 +1,27 @@
+#!/usr/bin/env bash
+
+# generate the deepcopy functions and the clientset of the LVMNode api
+# the generators are installed from k8s.io/code-generator at kubernetes-1.13.4,
+# the release of the vendored client-go, checked out at CODEGEN_PKG
+# the repo must be in the GOPATH, the generators write to it
+# there are no informers and listers, client-go/tools/cache is not vendored
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+SCRIPT_ROOT=$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)
+CODEGEN_PKG=${CODEGEN_PKG:-${GOPATH}/src/k8s.io/code-generator}
+PKG=github.com/tommenx/csi-lvm-plugin
+APIS=${PKG}/pkg/apis/lvmnode/v1alpha1
+HEADER=${SCRIPT_ROOT}/hack/boilerplate.go.txt
+
+(cd "${CODEGEN_PKG}" && go install ./cmd/{client-gen,deepcopy-gen})
+
+echo "Generating deepcopy funcs"
+"${GOPATH}/bin/deepcopy-gen" --input-dirs "${APIS}" -O zz_generated.deepcopy \
+  --bounding-dirs "${PKG}/pkg/apis" --go-header-file "${HEADER}"
+
+echo "Generating clientset at ${PKG}/pkg/client/clientset"
+"${GOPATH}/bin/client-gen" --clientset-name versioned --input-base "" --input "${APIS}" \
+  --output-package "${PKG}/pkg/client/clientset" --fake-clientset=false --go-header-file "${HEADER}"
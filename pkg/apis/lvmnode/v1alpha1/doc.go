@@ -0,0 +1,5 @@
+// Package v1alpha1 is the v1alpha1 version of the LVMNode api,
+// the lvm plugin reports the volume groups, thin pools and volumes of a node in it
+// +k8s:deepcopy-gen=package
+// +groupName=lvmplugin.csi.alibabacloud.com
+package v1alpha1
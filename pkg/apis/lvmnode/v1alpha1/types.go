@@ -0,0 +1,83 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LVMNode is the lvm storage of a node, it is named after the node
+type LVMNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LVMNodeSpec   `json:"spec"`
+	Status LVMNodeStatus `json:"status,omitempty"`
+}
+
+// LVMNodeSpec is the node the storage belongs to
+type LVMNodeSpec struct {
+	NodeID string `json:"nodeID"`
+}
+
+// LVMNodeStatus is reported by the plugin on the node
+type LVMNodeStatus struct {
+	VolumeGroups []VolumeGroup `json:"volumeGroups,omitempty"`
+	ThinPools    []ThinPool    `json:"thinPools,omitempty"`
+	Allocations  []Allocation  `json:"allocations,omitempty"`
+	// the last time the status is reported
+	UpdateTime metav1.Time `json:"updateTime,omitempty"`
+}
+
+// VolumeGroup is a volume group the plugin can use
+type VolumeGroup struct {
+	Name string `json:"name"`
+	// size of the volume group in bytes
+	Size int64 `json:"size"`
+	// free space of the volume group in bytes
+	Free    int64    `json:"free"`
+	PvCount int64    `json:"pvCount,omitempty"`
+	LvCount int64    `json:"lvCount,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// ThinPool is a thin pool in a volume group
+type ThinPool struct {
+	Name        string `json:"name"`
+	VolumeGroup string `json:"volumeGroup"`
+	// size of the pool in bytes
+	Size int64 `json:"size"`
+	// percent of the data of the pool in use
+	DataPercent string `json:"dataPercent,omitempty"`
+}
+
+// Allocation is a volume created by the plugin
+type Allocation struct {
+	VolID       string   `json:"volID"`
+	VolName     string   `json:"volName"`
+	VolumeGroup string   `json:"volumeGroup"`
+	LvmName     string   `json:"lvmName"`
+	ThinPool    string   `json:"thinPool,omitempty"`
+	Size        int64    `json:"size"`
+	Limits      IOLimits `json:"ioLimits,omitempty"`
+}
+
+// IOLimits are the io limits of a volume, 0 means unlimited
+type IOLimits struct {
+	ReadBps   uint64 `json:"readBps,omitempty"`
+	WriteBps  uint64 `json:"writeBps,omitempty"`
+	ReadIops  uint64 `json:"readIops,omitempty"`
+	WriteIops uint64 `json:"writeIops,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LVMNodeList is a list of LVMNode
+type LVMNodeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LVMNode `json:"items"`
+}
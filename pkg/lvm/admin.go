@@ -0,0 +1,173 @@
+package lvm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// OrphanReport compares the lv on the disk with the journal of the driver
+type OrphanReport struct {
+	// lv tagged by the driver but not in the journal
+	Unknown []string `json:"unknown"`
+	// volumes in the journal without a lv
+	Missing []string `json:"missing"`
+}
+
+// ListDriverVolumes lists the volumes created by the driver, read from the lv tags
+func ListDriverVolumes(exec mount.Exec) ([]lvmVolume, error) {
+	lvs, err := listLVs(exec)
+	if err != nil {
+		return nil, err
+	}
+	vols := []lvmVolume{}
+	for i := range lvs {
+		if vol := volumeFromLV(&lvs[i]); vol != nil {
+			vols = append(vols, *vol)
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].VolID < vols[j].VolID })
+	return vols, nil
+}
+
+// PVCNames maps the name of the volumes to the namespace/name of their pvc
+func PVCNames(client k8s.Interface) (map[string]string, error) {
+	pvcs, err := client.CoreV1().PersistentVolumeClaims("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, pvc := range pvcs.Items {
+		if len(pvc.Spec.VolumeName) != 0 {
+			names[pvc.Spec.VolumeName] = pvc.Namespace + "/" + pvc.Name
+		}
+	}
+	return names, nil
+}
+
+// CgroupLimits reads the rules of the device of the volume in the cgroups of the pods using it,
+// which are the limits actually applied on the node, keyed by <pod uid>/<throttle file>
+func CgroupLimits(vol *lvmVolume) (map[string]string, error) {
+	device := fmt.Sprintf("%s:%s ", vol.Maj, vol.Min)
+	files := []string{"blkio.throttle.read_bps_device", "blkio.throttle.write_bps_device",
+		"blkio.throttle.read_iops_device", "blkio.throttle.write_iops_device"}
+	if isCgroupV2() {
+		files = []string{"io.max"}
+	}
+	limits := map[string]string{}
+	for _, targetPath := range publishedTargetPaths(vol) {
+		uid := podUIDFromTargetPath(targetPath)
+		dir, err := findPodCgroup(uid)
+		if err != nil {
+			glog.Warningf("volume %s is published to %s, %v", vol.VolID, targetPath, err)
+			continue
+		}
+		for _, f := range files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, f))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, device) {
+					limits[uid+"/"+f] = strings.TrimPrefix(line, device)
+				}
+			}
+		}
+	}
+	return limits, nil
+}
+
+// FindOrphans compares the lv tagged by the driver with the journal
+func FindOrphans(exec mount.Exec) (*OrphanReport, error) {
+	vols, err := ListDriverVolumes(exec)
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	report := &OrphanReport{Unknown: []string{}, Missing: []string{}}
+	known := map[string]bool{}
+	for _, vol := range state.Volumes {
+		known[vol.VolID] = true
+	}
+	found := map[string]bool{}
+	for _, vol := range vols {
+		found[vol.VolID] = true
+		if !known[vol.VolID] {
+			report.Unknown = append(report.Unknown, vol.VolID)
+		}
+	}
+	for _, vol := range state.Volumes {
+		// volumes registered by ControllerPublishVolume have no lv of their own
+		if vol.VolSize != 0 && !found[vol.VolID] {
+			report.Missing = append(report.Missing, vol.VolID)
+		}
+	}
+	sort.Strings(report.Unknown)
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+// ForceDeleteVolume removes the lv of the volume and its entry in the journal
+// the snapshots of the volume must be deleted first
+// the driver keeps the journal in memory and writes it back, so it must not be running
+func ForceDeleteVolume(exec mount.Exec, volumeId string) error {
+	lock, err := lockState(false)
+	if err == errStateLocked {
+		return fmt.Errorf("the driver is running, delete the pvc of volume %s or stop the driver on the node first", volumeId)
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	for _, snap := range state.Snapshots {
+		if snap.SourceVolID == volumeId {
+			return fmt.Errorf("volume %s has snapshot %s", volumeId, snap.SnapID)
+		}
+	}
+	vols, err := ListDriverVolumes(exec)
+	if err != nil {
+		return err
+	}
+	var vol *lvmVolume
+	for i := range vols {
+		if vols[i].VolID == volumeId {
+			vol = &vols[i]
+			break
+		}
+	}
+	if vol != nil {
+		args := []string{"-f", "-y", fmt.Sprintf("%s/%s", vol.VolumeGroup, vol.LvmName)}
+		if _, err := runLVM(exec, "lvremove", args); err != nil {
+			return err
+		}
+	}
+	volumes := []lvmVolume{}
+	for _, v := range state.Volumes {
+		if v.VolID != volumeId {
+			volumes = append(volumes, v)
+		}
+	}
+	if vol == nil && len(volumes) == len(state.Volumes) {
+		return fmt.Errorf("can't find volume %s", volumeId)
+	}
+	state.Volumes = volumes
+	return saveState(stateFile, state)
+}
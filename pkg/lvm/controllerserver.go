@@ -3,39 +3,193 @@ package lvm
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pborman/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
 	k8sCache *ConfigCache
+	nodeID   string
+	// runs the lvm commands, tests replace it with a fake
+	exec mount.Exec
 }
 
-var lvmVolumes = make(map[string]*lvmVolume)
+const (
+	// size of the snapshot copy-on-write area, as a percent of the source volume
+	snapshotSizePercentKey     = "snapshotSizePercent"
+	defaultSnapshotSizePercent = 20
+	// create thin volumes in the thin pool of the vg
+	thinPoolKey = "thinpool"
+	// the ratio was a parameter of the storage class, it is now set per pool on the driver
+	overProvisionRatioKey = "overProvisionRatio"
+)
 
 func transVolumes2Allocation() AllocationsLVM {
 	allocation := AllocationsLVM{}
-	for _, v := range lvmVolumes {
+	for _, v := range registry.listVolumes() {
 		allocation.Allocation = append(allocation.Allocation, *v)
 	}
 	return allocation
 }
 
-func NewControllerServer(d *csicommon.CSIDriver, cache *ConfigCache) csi.ControllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, nodeID string, cache *ConfigCache) csi.ControllerServer {
 	c := &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
 		k8sCache:                cache,
+		nodeID:                  nodeID,
+		exec:                    mount.NewOsExec(),
+	}
+	// wait for lvmctl to finish with the journal, then keep it to the driver
+	if lock, err := lockState(true); err != nil {
+		glog.Errorf("ControllerServer: can't lock %s, %v", stateFile, err)
+	} else {
+		stateLock = lock
+	}
+	if err := restoreState(); err != nil {
+		glog.Errorf("ControllerServer: can't restore volumes from %s, %v", stateFile, err)
+	}
+	c.importLegacyVolumes()
+	report, err := reconcileVolumes(c.exec)
+	if err != nil {
+		glog.Errorf("ControllerServer: can't reconcile volumes with lv tags, %v", err)
+		return c
+	}
+	for _, id := range report.Unknown {
+		glog.Warningf("ControllerServer: volume %s is tagged on the disk but unknown, add it back", id)
+	}
+	for _, id := range report.Missing {
+		glog.Warningf("ControllerServer: volume %s is known but its lv is missing", id)
+	}
+	if err := persistState(); err != nil {
+		glog.Errorf("ControllerServer: can't persist reconciled volumes, %v", err)
 	}
 	return c
 }
 
+// add the volumes kept in the configmap by the older versions of the driver,
+// so they are journaled and stay in the allocation of the lvmnode
+// a volume whose lv is gone was deleted since and is not added back
+func (cs *controllerServer) importLegacyVolumes() {
+	if cs.k8sCache == nil {
+		return
+	}
+	allocation, ok := cs.k8sCache.legacyAllocation()
+	if !ok {
+		return
+	}
+	for i := range allocation.Allocation {
+		vol := &allocation.Allocation[i]
+		if vol.VolSize == 0 {
+			continue
+		}
+		if _, ok := registry.getVolume(vol.VolID); ok {
+			continue
+		}
+		if _, err := getLV(cs.exec, vol.VolumeGroup, vol.LvmName); err != nil {
+			glog.Warningf("ControllerServer: skip volume %s of the configmap, %v", vol.VolID, err)
+			continue
+		}
+		glog.V(4).Infof("ControllerServer: import volume %s of the configmap", vol.VolID)
+		registry.putVolume(vol)
+	}
+}
+
+// update the node info and the allocation in the lvmnode
+func (cs *controllerServer) updateCache() {
+	if cs.k8sCache == nil {
+		return
+	}
+	node, err := GetNodeInfo(cs.exec)
+	if err != nil {
+		glog.Errorf("ControllerServer: can't get node info, %v", err)
+	} else if err := cs.k8sCache.Update(*node); err != nil {
+		glog.Errorf("ControllerServer: can't update lvmnode of node, %v", err)
+	}
+	allocation := transVolumes2Allocation()
+	for _, v := range allocation.Allocation {
+		glog.V(4).Infof("%v", v)
+	}
+	if err := cs.k8sCache.Update(allocation); err != nil {
+		glog.Errorf("ControllerServer: can't update lvmnode of allocation, %v", err)
+	}
+}
+
+// check the thin pool exists and has room for the volume under the overprovisioning ratio
+func checkThinPool(exec mount.Exec, method, vg, pool string, size int64) error {
+	info, err := getThinPoolInfo(exec, vg, pool)
+	if err != nil {
+		glog.Errorf("%s: can't get usage of thin pool %s/%s, %v", method, vg, pool, err)
+		return status.Errorf(codes.InvalidArgument, "%s: invalid thin pool %s/%s", method, vg, pool)
+	}
+	r, ok := overProvisionRatio(vg, pool)
+	if !ok {
+		return nil
+	}
+	if float64(info.VirtualSize+size) > float64(info.Size)*r {
+		glog.Errorf("%s: thin pool %s/%s of %d bytes has %d bytes allocated, can't allocate %d bytes more with ratio %v",
+			method, vg, pool, info.Size, info.VirtualSize, size, r)
+		return status.Errorf(codes.ResourceExhausted, "%s: thin pool %s/%s exceeds the overprovisioning ratio %v", method, vg, pool, r)
+	}
+	return nil
+}
+
+// the lv can only be created on the node of the controller
+func (cs *controllerServer) accessibleTopology() []*csi.Topology {
+	return []*csi.Topology{
+		{Segments: map[string]string{TopologyKey: cs.nodeID}},
+	}
+}
+
+// a topology without the node key does not constrain the node
+func (cs *controllerServer) topologyMatches(topologies []*csi.Topology) bool {
+	for _, t := range topologies {
+		node, ok := t.GetSegments()[TopologyKey]
+		if !ok || node == cs.nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// the reason why the existing volume doesn't match the requested one, empty if it does
+// the size of the existing volume may be larger than required but not over the limit
+func volumeMismatch(vol, requested *lvmVolume, limitBytes int64, params map[string]string) string {
+	if vol.VolSize < requested.VolSize {
+		return fmt.Sprintf("size %d smaller than %d", vol.VolSize, requested.VolSize)
+	}
+	if limitBytes > 0 && vol.VolSize > limitBytes {
+		return fmt.Sprintf("size %d larger than the limit %d", vol.VolSize, limitBytes)
+	}
+	if vgs := SplitList(params["vg"]); len(vgs) != 0 {
+		found := false
+		for _, vg := range vgs {
+			found = found || vg == vol.VolumeGroup
+		}
+		if !found {
+			return fmt.Sprintf("vg %s not in %v", vol.VolumeGroup, vgs)
+		}
+	}
+	if vol.ThinPool != requested.ThinPool {
+		return fmt.Sprintf("thin pool %q instead of %q", vol.ThinPool, requested.ThinPool)
+	}
+	// the annotations of the pvc may have changed the limits since, compare those of the class
+	if vol.classLimits() != requested.ioLimits() {
+		return fmt.Sprintf("io limits %+v instead of %+v", vol.classLimits(), requested.ioLimits())
+	}
+	return ""
+}
+
 // provisioner create/delete lvm image
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
@@ -51,9 +205,9 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
 
-	if _, ok := req.GetParameters()["vg"]; !ok {
-		glog.Errorf("CreateVolume: error VolumeGroup from input")
-		return nil, status.Error(codes.InvalidArgument, "CreateVolume: error VolumeGroup from input")
+	if requisite := req.GetAccessibilityRequirements().GetRequisite(); len(requisite) != 0 && !cs.topologyMatches(requisite) {
+		glog.Errorf("CreateVolume: node %s is not in the requisite topology %v", cs.nodeID, requisite)
+		return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: node %s is not in the requisite topology", cs.nodeID)
 	}
 	lvmVol := &lvmVolume{}
 	// if bps is null , it is set to nil
@@ -62,64 +216,151 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	} else {
 		lvmVol.Bps = "0"
 	}
+	limits, err := parseIOLimits(req.GetParameters())
+	if err != nil {
+		glog.Errorf("CreateVolume: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	lvmVol.Limits = limits
+	lvmVol.ClassLimits = &limits
 	lvmVol.VolName = req.Name
+	lvmVol.VolID = volumeIDFromName(req.Name)
+	// the volume and its content source are locked until the volume is created
+	locked := []string{lvmVol.VolID}
+	if source := req.GetVolumeContentSource(); source.GetSnapshot() != nil {
+		locked = append(locked, source.GetSnapshot().GetSnapshotId())
+	} else if source.GetVolume() != nil {
+		locked = append(locked, source.GetVolume().GetVolumeId())
+	}
+	done, err := startOperation("CreateVolume", locked...)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// the content source must be in the chosen vg and not larger than the volume
+	var srcVG, srcName string
+	var srcSize int64
+	if source := req.GetVolumeContentSource(); source != nil {
+		switch {
+		case source.GetSnapshot() != nil:
+			snap, ok := registry.getSnapshot(source.GetSnapshot().GetSnapshotId())
+			if !ok {
+				return nil, status.Errorf(codes.NotFound, "CreateVolume: can't find source snapshot %s", source.GetSnapshot().GetSnapshotId())
+			}
+			srcVG, srcName, srcSize = snap.VolumeGroup, snap.LvmName, snap.SourceSize
+		case source.GetVolume() != nil:
+			src, ok := registry.getVolume(source.GetVolume().GetVolumeId())
+			if !ok || src.VolSize == 0 {
+				return nil, status.Errorf(codes.NotFound, "CreateVolume: can't find source volume %s", source.GetVolume().GetVolumeId())
+			}
+			srcVG, srcName, srcSize = src.VolumeGroup, src.LvmName, src.VolSize
+		default:
+			return nil, status.Error(codes.InvalidArgument, "CreateVolume: unsupported volume content source")
+		}
+	}
 	if req.GetCapacityRange() != nil {
 		lvmVol.VolSize = int64(req.GetCapacityRange().GetRequiredBytes())
+	} else if srcSize > 0 {
+		lvmVol.VolSize = srcSize
 	} else {
 		lvmVol.VolSize = 1024 * 1024 * 1024
 	}
-	// find by name if exsist the same
-	vol, _ := getLVMVolumeByName(req.Name)
-	if vol != nil {
-		if vol.VolSize != lvmVol.VolSize {
-			// glog.V(4).Infof("CreateVolume: exist disk %s size is different with requested for disk: exist size: %s, request size: %s", req.GetName(), vol.VolSize, lvmVol.VolSize)
-			return nil, status.Errorf(codes.Internal, "disk %s size is different with requested for disk", req.GetName())
-		} else {
-			tmpVol := &csi.Volume{
-				VolumeId:      vol.VolID,
-				CapacityBytes: vol.VolSize,
-				VolumeContext: req.GetParameters(),
+	if lvmVol.VolSize < srcSize {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: requested size %d is smaller than the source size %d", lvmVol.VolSize, srcSize)
+	}
+	// a thin source is cloned by a thin snapshot, which is always in the pool of the source
+	lvmVol.ThinPool = req.GetParameters()[thinPoolKey]
+	if len(srcName) != 0 {
+		src, err := getLV(cs.exec, srcVG, srcName)
+		if err != nil {
+			glog.Errorf("CreateVolume: can't get source lv %s/%s, %v", srcVG, srcName, err)
+			return nil, status.Errorf(codes.Internal, "CreateVolume: can't get source lv %s/%s", srcVG, srcName)
+		}
+		if isThinLV(src) {
+			if len(lvmVol.ThinPool) != 0 && lvmVol.ThinPool != src.PoolLv {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: source is in thin pool %s, not in %s", src.PoolLv, lvmVol.ThinPool)
 			}
-			return &csi.CreateVolumeResponse{Volume: tmpVol}, nil
+			lvmVol.ThinPool = src.PoolLv
 		}
 	}
-	// create LVM image
-	lvmVol.VolID = uuid.NewUUID().String()
-	lvmVol.VolumeGroup = req.GetParameters()["vg"]
-	err := createLVMDevice(lvmVol)
+	// a volume of the same name is returned as it is if it matches the request,
+	// the lv may only be on the disk if the driver stopped before persisting the state
+	vol, ok := registry.volumeByName(req.Name)
+	if !ok {
+		vol, err = findVolumeOnDisk(cs.exec, req.Name)
+		if err != nil && !isNotFound(err) {
+			glog.Errorf("CreateVolume: can't look up volume %s, %v", req.Name, err)
+			return nil, status.Errorf(codes.Internal, "CreateVolume: can't look up volume %s", req.Name)
+		}
+		if vol != nil {
+			glog.V(4).Infof("CreateVolume: take over volume %s found on lv %s/%s", vol.VolID, vol.VolumeGroup, vol.LvmName)
+			registry.putVolume(vol)
+			if err := persistState(); err != nil {
+				registry.deleteVolume(vol.VolID)
+				glog.Errorf("CreateVolume: can't persist volume %s, %v", vol.VolID, err)
+				return nil, status.Errorf(codes.Internal, "CreateVolume: can't persist volume %s", vol.VolID)
+			}
+			cs.updateCache()
+		}
+	}
+	if vol != nil {
+		if reason := volumeMismatch(vol, lvmVol, req.GetCapacityRange().GetLimitBytes(), req.GetParameters()); len(reason) != 0 {
+			glog.Errorf("CreateVolume: volume %s exists with %s", req.Name, reason)
+			return nil, status.Errorf(codes.AlreadyExists, "CreateVolume: volume %s exists with %s", req.Name, reason)
+		}
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           vol.VolID,
+				CapacityBytes:      vol.VolSize,
+				VolumeContext:      volumeContext(req.GetParameters(), vol.VolumeGroup),
+				ContentSource:      req.GetVolumeContentSource(),
+				AccessibleTopology: cs.accessibleTopology(),
+			},
+		}, nil
+	}
+	vgName, err := chooseVolumeGroup(cs.exec, req.GetParameters(), lvmVol.VolSize, srcVG)
 	if err != nil {
 		return nil, err
 	}
-	// set bps
-	ok, maj, min := getDeviceNum(lvmVol)
-	if !ok {
-		glog.V(4).Infoln("ControllerServer:can't get device number")
-	} else {
-		lvmVol.Maj = maj
-		lvmVol.Min = min
+	if _, ok := req.GetParameters()[overProvisionRatioKey]; ok {
+		glog.Warningf("CreateVolume: %s of the storage class is ignored, it is set per thin pool on the driver", overProvisionRatioKey)
 	}
-	setBps(lvmVol)
-	// add to lvmvolume slice
-	lvmVolumes[lvmVol.VolID] = lvmVol
-
-	node, _ := GetNodeInfo()
-	err = cs.k8sCache.Update(node)
-	if err != nil {
-		glog.Errorf("ControllerServer: can't update configmap of node")
+	if pool := lvmVol.ThinPool; len(pool) != 0 {
+		// the pool is held until the lv is created, it is released when CreateVolume returns
+		defer lockThinPool(vgName, pool)()
+		if err := checkThinPool(cs.exec, "CreateVolume", vgName, pool, lvmVol.VolSize); err != nil {
+			return nil, err
+		}
 	}
-	allocation := transVolumes2Allocation()
-	for _, v := range allocation.Allocation {
-		glog.V(4).Infof("%v", v)
+	// create LVM image
+	lvmVol.VolumeGroup = vgName
+	if len(srcName) != 0 {
+		err = cloneLVMDevice(cs.exec, lvmVol, srcVG, srcName)
+	} else {
+		err = createLVMDevice(cs.exec, lvmVol)
 	}
-	err = cs.k8sCache.Update(allocation)
 	if err != nil {
-		glog.Errorf("ControllerServer: can't update configmap of allocation")
+		return nil, err
 	}
+	// add to lvmvolume slice, the lv is removed again if the state can't be persisted
+	// so that the retry of the request starts over
+	registry.putVolume(lvmVol)
+	if err := persistState(); err != nil {
+		glog.Errorf("CreateVolume: can't persist volume %s, %v", lvmVol.VolID, err)
+		registry.deleteVolume(lvmVol.VolID)
+		if err := deleteLVMDevice(cs.exec, lvmVol); err != nil {
+			glog.Errorf("CreateVolume: can't roll back lv of volume %s, %v", lvmVol.VolID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "CreateVolume: can't persist volume %s", lvmVol.VolID)
+	}
+	cs.updateCache()
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      lvmVol.VolID,
-			CapacityBytes: lvmVol.VolSize,
-			VolumeContext: req.GetParameters(),
+			VolumeId:           lvmVol.VolID,
+			CapacityBytes:      lvmVol.VolSize,
+			VolumeContext:      volumeContext(req.GetParameters(), lvmVol.VolumeGroup),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: cs.accessibleTopology(),
 		},
 	}, nil
 }
@@ -131,44 +372,59 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		glog.Errorf("DeleteVolume: Invaild delete volume args %v", err)
 		return nil, status.Errorf(codes.InvalidArgument, "DeleteVolume: invalid delete volume args %v", err)
 	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolume: volume id cannot be empty")
+	}
+	done, err := startOperation("DeleteVolume", req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	// find lvmVol from lvmVols
-	vol, ok := lvmVolumes[req.VolumeId]
+	vol, ok := registry.getVolume(req.VolumeId)
 	if !ok {
 		glog.V(4).Infof("DeleteVolume: Can't find the request volumeId %s", req.VolumeId)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	// lvremove of the origin removes its snapshots as well
+	for _, snap := range registry.listSnapshots() {
+		if snap.SourceVolID == vol.VolID {
+			glog.Errorf("DeleteVolume: volume %s still has snapshot %s", vol.VolID, snap.SnapID)
+			return nil, status.Errorf(codes.FailedPrecondition, "DeleteVolume: volume %s still has snapshots", req.GetVolumeId())
+		}
+	}
 	// remove the request lv
-	err := deleteLVMDevice(vol)
-	if err != nil {
+	if err := deleteLVMDevice(cs.exec, vol); err != nil {
 		glog.Errorf("DeleteVolume: Can't remove %s from %s with the path %s", vol.LvmName, vol.VolumeGroup, vol.MapperPath)
 		return nil, status.Errorf(codes.Internal, "DeleteVolume: Can't remove lv %s", req.GetVolumeId())
 	}
-	// remove from the map
-	delete(lvmVolumes, req.GetVolumeId())
-	// update configmap
-	node, _ := GetNodeInfo()
-	err = cs.k8sCache.Update(node)
-	if err != nil {
-		glog.Errorf("ControllerServer: can't update configmap")
-	}
-	allocation := transVolumes2Allocation()
-	err = cs.k8sCache.Update(allocation)
-	if err != nil {
-		glog.Errorf("ControllerServer: can't update configmap of allocation")
+	// remove from the registry
+	registry.deleteVolume(req.GetVolumeId())
+	if err := persistState(); err != nil {
+		glog.Errorf("DeleteVolume: can't persist volumes, %v", err)
+		return nil, status.Errorf(codes.Internal, "DeleteVolume: can't persist volume %s", req.GetVolumeId())
 	}
+	// update configmap
+	cs.updateCache()
 	// return result
 	return &csi.DeleteVolumeResponse{}, nil
 }
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	// step 1 check the volume id
 	// step 2 if exist,return
-	// step 3 if not,create lvmVolume,add to lvmVolumes
+	// step 3 if not,create lvmVolume,add to the registry
 
-	// volumeId == volName
 	// do not specify volSize
 	volumeId := req.GetVolumeId()
-	_, ok := lvmVolumes[volumeId]
-	if ok {
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume: volume id cannot be empty")
+	}
+	done, err := startOperation("ControllerPublishVolume", volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if _, ok := registry.getVolume(volumeId); ok {
 		return &csi.ControllerPublishVolumeResponse{}, nil
 	}
 	params := req.GetVolumeContext()
@@ -189,11 +445,22 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	} else {
 		lvm.Bps = params["bps"]
 	}
-	lvm.LvmName = volumeId
+	if limits, err := parseIOLimits(params); err == nil {
+		lvm.Limits = limits
+	} else {
+		glog.Errorf("ControllerPublishVolume: %s has invalid io limits, %v", volumeId, err)
+	}
+	// the lv is found by its tag, the volumes created before the names were derived from the id are named by lvm
+	lvm.LvmName = lvNameFor(volumeId)
+	if lv, err := findVolumeLV(cs.exec, lvm.VolumeGroup, volumeId); err == nil {
+		lvm.LvmName = lv.LvName
+	} else {
+		glog.Warningf("ControllerPublishVolume: can't find lv of %s, use %s, %v", volumeId, lvm.LvmName, err)
+	}
 	lvm.VolID = volumeId
 	lvm.DevicePath = fmt.Sprintf("/dev/%s/%s", lvm.VolumeGroup, lvm.LvmName)
-	lvm.MapperPath = fmt.Sprintf("/dev/mapper/%s-%s", lvm.VolumeGroup, lvm.LvmName)
-	lvmVolumes[lvm.VolID] = lvm
+	lvm.MapperPath = lvMapperPath(lvm.VolumeGroup, lvm.LvmName)
+	registry.putVolume(lvm)
 	return &csi.ControllerPublishVolumeResponse{}, nil
 
 }
@@ -201,11 +468,325 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	// glog.V(4).Infof("ControllerUnpublishVolume is called, do nothing by now")
 	volumeId := req.GetVolumeId()
-	vol, ok := lvmVolumes[volumeId]
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume: volume id cannot be empty")
+	}
+	done, err := startOperation("ControllerUnpublishVolume", volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	vol, ok := registry.getVolume(volumeId)
 	if ok {
 		if vol.VolSize == 0 {
-			delete(lvmVolumes, volumeId)
+			registry.deleteVolume(volumeId)
 		}
 	}
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
+
+// list the volumes created by the driver, ordered by volume id
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.Errorf("ListVolumes: driver not support list volumes: %v", err)
+		return nil, err
+	}
+	vols := []*lvmVolume{}
+	for _, vol := range registry.listVolumes() {
+		// volumes registered by ControllerPublishVolume are not created by the driver
+		if vol.VolSize == 0 {
+			continue
+		}
+		vols = append(vols, vol)
+	}
+	start, end, next, err := paginate(len(vols), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListVolumesResponse{NextToken: next}
+	for _, vol := range vols[start:end] {
+		volCtx := map[string]string{"vg": vol.VolumeGroup}
+		if len(vol.ThinPool) != 0 {
+			volCtx[thinPoolKey] = vol.ThinPool
+		}
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:           vol.VolID,
+				CapacityBytes:      vol.VolSize,
+				VolumeContext:      volCtx,
+				AccessibleTopology: cs.accessibleTopology(),
+			},
+		})
+	}
+	return resp, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.Errorf("CreateSnapshot: driver not support create snapshot: %v", err)
+		return nil, err
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: snapshot name cannot be empty")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot: source volume id cannot be empty")
+	}
+	percent := defaultSnapshotSizePercent
+	if str, ok := req.GetParameters()[snapshotSizePercentKey]; ok {
+		p, err := strconv.Atoi(str)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot: invalid %s %q", snapshotSizePercentKey, str)
+		}
+		percent = p
+	}
+	// snapshots of the same name are created one at a time, and not while the source is changed
+	done, err := startOperation("CreateSnapshot", req.GetSourceVolumeId(), snapshotNameKey(req.GetName()))
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// find by name if exsist the same
+	for _, snap := range registry.listSnapshots() {
+		if snap.SnapName != req.GetName() {
+			continue
+		}
+		if snap.SourceVolID != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "CreateSnapshot: snapshot %s already exists with another source volume", req.GetName())
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: transSnapshot(snap)}, nil
+	}
+	source, ok := registry.getVolume(req.GetSourceVolumeId())
+	if !ok || source.VolSize == 0 {
+		glog.Errorf("CreateSnapshot: can't find source volume %s", req.GetSourceVolumeId())
+		return nil, status.Errorf(codes.NotFound, "CreateSnapshot: can't find source volume %s", req.GetSourceVolumeId())
+	}
+	snap := &lvmSnapshot{
+		SnapName:     req.GetName(),
+		SnapID:       uuid.NewUUID().String(),
+		SourceVolID:  source.VolID,
+		CreationTime: time.Now().UnixNano(),
+	}
+	if err := createLVMSnapshot(cs.exec, snap, source, percent); err != nil {
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot: can't create snapshot of %s", source.VolID)
+	}
+	registry.putSnapshot(snap)
+	if err := persistState(); err != nil {
+		glog.Errorf("CreateSnapshot: can't persist snapshot %s, %v", snap.SnapID, err)
+		return nil, status.Errorf(codes.Internal, "CreateSnapshot: can't persist snapshot %s", snap.SnapID)
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: transSnapshot(snap)}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	glog.V(4).Infof("DeleteSnapshot: Starting delete snapshot %s", req.GetSnapshotId())
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		glog.Errorf("DeleteSnapshot: driver not support delete snapshot: %v", err)
+		return nil, err
+	}
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot: snapshot id cannot be empty")
+	}
+	done, err := startOperation("DeleteSnapshot", req.GetSnapshotId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	snap, ok := registry.getSnapshot(req.GetSnapshotId())
+	if !ok {
+		glog.V(4).Infof("DeleteSnapshot: Can't find the request snapshot %s", req.GetSnapshotId())
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err := deleteLVMSnapshot(cs.exec, snap); err != nil {
+		return nil, status.Errorf(codes.Internal, "DeleteSnapshot: Can't remove snapshot %s", req.GetSnapshotId())
+	}
+	registry.deleteSnapshot(req.GetSnapshotId())
+	if err := persistState(); err != nil {
+		glog.Errorf("DeleteSnapshot: can't persist snapshots, %v", err)
+		return nil, status.Errorf(codes.Internal, "DeleteSnapshot: can't persist snapshot %s", req.GetSnapshotId())
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		glog.Errorf("ListSnapshots: driver not support list snapshots: %v", err)
+		return nil, err
+	}
+	snaps := []*lvmSnapshot{}
+	for _, snap := range registry.listSnapshots() {
+		if len(req.GetSnapshotId()) != 0 && snap.SnapID != req.GetSnapshotId() {
+			continue
+		}
+		if len(req.GetSourceVolumeId()) != 0 && snap.SourceVolID != req.GetSourceVolumeId() {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	start, end, next, err := paginate(len(snaps), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListSnapshotsResponse{NextToken: next}
+	for _, snap := range snaps[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: transSnapshot(snap)})
+	}
+	return resp, nil
+}
+
+func transSnapshot(snap *lvmSnapshot) *csi.Snapshot {
+	created, err := ptypes.TimestampProto(time.Unix(0, snap.CreationTime))
+	if err != nil {
+		glog.Errorf("snapshot %s has invalid creation time %d", snap.SnapID, snap.CreationTime)
+	}
+	return &csi.Snapshot{
+		SizeBytes:      snap.SourceSize,
+		SnapshotId:     snap.SnapID,
+		SourceVolumeId: snap.SourceVolID,
+		CreationTime:   created,
+		ReadyToUse:     true,
+	}
+}
+
+// the starting token is the offset of the first entry
+// return the range [start, end) of the page and the token of the next page
+func paginate(total int, token string, maxEntries int32) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid max entries %d", maxEntries)
+	}
+	start := 0
+	if len(token) != 0 {
+		offset, err := strconv.Atoi(token)
+		if err != nil || offset < 0 || offset > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+		start = offset
+	}
+	end := total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+	}
+	next := ""
+	if end < total {
+		next = strconv.Itoa(end)
+	}
+	return start, end, next, nil
+}
+
+// grow the lv of the volume, the filesystem is grown by NodeExpandVolume
+// a block volume has no filesystem, so the node has nothing to do for it
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		glog.Errorf("ControllerExpandVolume: driver not support expand volume: %v", err)
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume: volume id cannot be empty")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume: capacity range cannot be empty")
+	}
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && size > limit {
+		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume: required bytes %d is over the limit %d", size, limit)
+	}
+	capacity, err := cs.expandVolume(req.GetVolumeId(), size)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacity,
+		NodeExpansionRequired: req.GetVolumeCapability().GetBlock() == nil,
+	}, nil
+}
+
+// the volumes are listed by ListVolumes, there is no GET_VOLUME capability
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// grow the lv of the volume to the size
+func (cs *controllerServer) expandVolume(volumeId string, size int64) (int64, error) {
+	done, err := startOperation("expandVolume", volumeId)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	vol, ok := registry.getVolume(volumeId)
+	if !ok || vol.VolSize == 0 {
+		return 0, status.Errorf(codes.NotFound, "expandVolume: can't find volume %s", volumeId)
+	}
+	if size <= vol.VolSize {
+		glog.V(4).Infof("expandVolume: volume %s is already %d bytes", volumeId, vol.VolSize)
+		return vol.VolSize, nil
+	}
+	// the growth of a thin volume is allocated in its pool like a new volume
+	if len(vol.ThinPool) != 0 {
+		defer lockThinPool(vol.VolumeGroup, vol.ThinPool)()
+		if err := checkThinPool(cs.exec, "expandVolume", vol.VolumeGroup, vol.ThinPool, size-vol.VolSize); err != nil {
+			return 0, err
+		}
+	}
+	if err := extendLV(cs.exec, vol.VolumeGroup, vol.LvmName, size); err != nil {
+		return 0, status.Errorf(codes.Internal, "expandVolume: can't extend lv of volume %s", volumeId)
+	}
+	oldSize := vol.VolSize
+	vol.VolSize = size
+	if err := retagLV(cs.exec, vol.VolumeGroup, vol.LvmName, lvTagSize, strconv.FormatInt(oldSize, 10), strconv.FormatInt(size, 10)); err != nil {
+		glog.Errorf("expandVolume: can't update size tag of volume %s, %v", volumeId, err)
+	}
+	registry.putVolume(vol)
+	if err := persistState(); err != nil {
+		glog.Errorf("expandVolume: can't persist volume %s, %v", volumeId, err)
+		return 0, status.Errorf(codes.Internal, "expandVolume: can't persist volume %s", volumeId)
+	}
+	cs.updateCache()
+	return vol.VolSize, nil
+}
+
+// free space of the largest candidate vg, or of the thin pool if the thinpool parameter is given
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.Errorf("GetCapacity: driver not support get capacity: %v", err)
+		return nil, err
+	}
+	if t := req.GetAccessibleTopology(); t != nil && !cs.topologyMatches([]*csi.Topology{t}) {
+		return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+	}
+	params := req.GetParameters()
+	vgName := params["vg"]
+	if pool := params[thinPoolKey]; len(pool) != 0 {
+		if len(vgName) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "GetCapacity: vg is required with %s", thinPoolKey)
+		}
+		if !allowedVGs.allowed(vgName) {
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+		info, err := getThinPoolInfo(cs.exec, vgName, pool)
+		if err != nil {
+			glog.Errorf("GetCapacity: can't get usage of thin pool %s/%s, %v", vgName, pool, err)
+			return nil, status.Errorf(codes.Internal, "GetCapacity: can't get usage of thin pool %s/%s", vgName, pool)
+		}
+		available := info.Size - info.UsedSize
+		if r, ok := overProvisionRatio(vgName, pool); ok {
+			available = int64(float64(info.Size)*r) - info.VirtualSize
+		}
+		if available < 0 {
+			available = 0
+		}
+		return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+	}
+	candidates, err := listVGCandidates(cs.exec, params)
+	if err != nil {
+		glog.Errorf("GetCapacity: can't list vg, %v", err)
+		return nil, status.Error(codes.Internal, "GetCapacity: can't list vg")
+	}
+	// a lv can't span vg, the largest volume fits in the vg with the most free space
+	var available int64
+	for _, c := range candidates {
+		if c.Free > available {
+			available = c.Free
+		}
+	}
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
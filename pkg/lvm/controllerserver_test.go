@@ -0,0 +1,525 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		total int
+		token string
+		max   int32
+		start int
+		end   int
+		next  string
+		code  codes.Code
+	}{
+		{5, "", 0, 0, 5, "", codes.OK},
+		{5, "", 2, 0, 2, "2", codes.OK},
+		{5, "2", 2, 2, 4, "4", codes.OK},
+		{5, "4", 2, 4, 5, "", codes.OK},
+		{5, "5", 2, 5, 5, "", codes.OK},
+		{5, "6", 2, 0, 0, "", codes.Aborted},
+		{5, "abc", 2, 0, 0, "", codes.Aborted},
+		{5, "", -1, 0, 0, "", codes.InvalidArgument},
+	}
+	for _, v := range tests {
+		start, end, next, err := paginate(v.total, v.token, v.max)
+		if status.Code(err) != v.code {
+			t.Errorf("paginate(%d, %q, %d) expect code %v, got %v", v.total, v.token, v.max, v.code, err)
+			continue
+		}
+		if start != v.start || end != v.end || next != v.next {
+			t.Errorf("paginate(%d, %q, %d) expect [%d, %d) %q, got [%d, %d) %q",
+				v.total, v.token, v.max, v.start, v.end, v.next, start, end, next)
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "test")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d)}
+
+	_, restore := withTestState(t)
+	defer restore()
+	for _, vol := range []*lvmVolume{
+		{VolID: "c", VolumeGroup: "vgdata", VolSize: 3},
+		{VolID: "a", VolumeGroup: "vgdata", VolSize: 1},
+		{VolID: "b", VolumeGroup: "vgssd", VolSize: 2},
+		{VolID: "p", VolumeGroup: "vgdata"},
+	} {
+		registry.putVolume(vol)
+	}
+
+	ids := []string{}
+	token := ""
+	for {
+		resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes error %v", err)
+		}
+		for _, e := range resp.Entries {
+			ids = append(ids, e.Volume.VolumeId)
+			vol, _ := registry.getVolume(e.Volume.VolumeId)
+			if e.Volume.CapacityBytes != vol.VolSize || e.Volume.VolumeContext["vg"] != vol.VolumeGroup {
+				t.Errorf("unexpected entry %v", e.Volume)
+			}
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" {
+		t.Errorf("expect [a b c], got %v", ids)
+	}
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "x"}); status.Code(err) != codes.Aborted {
+		t.Errorf("expect aborted for invalid token, got %v", err)
+	}
+}
+
+// CreateVolume of the same name returns the volume created before, even if the journal lost it
+func TestCreateVolumeIdempotent(t *testing.T) {
+	dir, restore := withTestState(t)
+	defer restore()
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	request := func(name string, size int64, params map[string]string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters: params,
+		}
+	}
+	params := map[string]string{"vg": "vgdata", writeBpsKey: "10Mi"}
+
+	created, err := cs.CreateVolume(context.Background(), request("pvc-1", GBSIZE, params))
+	if err != nil {
+		t.Fatalf("CreateVolume error %v", err)
+	}
+	// the driver stopped before the journal was written
+	registry = newVolumeRegistry()
+	retry, err := cs.CreateVolume(context.Background(), request("pvc-1", GBSIZE, params))
+	if err != nil || retry.Volume.VolumeId != created.Volume.VolumeId || retry.Volume.CapacityBytes != GBSIZE {
+		t.Fatalf("retry should return volume %v, got %v, %v", created.Volume, retry, err)
+	}
+	if _, ok := registry.getVolume(created.Volume.VolumeId); len(fake.lvs) != 1 || !ok {
+		t.Errorf("retry should take over lv %+v", fake.lvs)
+	}
+	state, err := loadState(stateFile)
+	if err != nil || len(state.Volumes) != 1 {
+		t.Errorf("volume taken over should be persisted, got %+v, %v", state, err)
+	}
+
+	mismatches := []*csi.CreateVolumeRequest{
+		request("pvc-1", 2*GBSIZE, params),
+		request("pvc-1", GBSIZE, map[string]string{"vg": "vgdata", writeBpsKey: "20Mi"}),
+		request("pvc-1", GBSIZE, map[string]string{"vg": "vgssd"}),
+	}
+	for _, req := range mismatches {
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("CreateVolume %v should be AlreadyExists, got %v", req.Parameters, err)
+		}
+	}
+
+	// the lv is removed again if the state can't be persisted
+	stateFile = filepath.Join(dir, "volumes.json", "volumes.json")
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-2", GBSIZE, params)); status.Code(err) != codes.Internal {
+		t.Errorf("CreateVolume should fail to persist, got %v", err)
+	}
+	if len(fake.lvs) != 1 || len(registry.listVolumes()) != 1 {
+		t.Errorf("lv of pvc-2 should be rolled back, got %+v", fake.lvs)
+	}
+}
+
+func TestSetOverProvisionRatios(t *testing.T) {
+	saved := thinPoolRatios
+	defer func() { thinPoolRatios = saved }()
+	if err := SetOverProvisionRatios([]string{"vgdata/pool0=2.5", "vgssd/pool1=1"}); err != nil {
+		t.Fatalf("SetOverProvisionRatios error %v", err)
+	}
+	if r, ok := overProvisionRatio("vgdata", "pool0"); !ok || r != 2.5 {
+		t.Errorf("expect ratio 2.5 of vgdata/pool0, got %v, %v", r, ok)
+	}
+	if _, ok := overProvisionRatio("vgdata", "pool1"); ok {
+		t.Errorf("vgdata/pool1 should have no ratio")
+	}
+	for _, items := range [][]string{{"pool0=2"}, {"vgdata/pool0"}, {"vgdata/pool0=0"}, {"vgdata/pool0=x"}} {
+		if err := SetOverProvisionRatios(items); err == nil {
+			t.Errorf("%v should be invalid", items)
+		}
+	}
+}
+
+// concurrent creates in a thin pool can't overcommit it beyond the ratio of the pool
+func TestThinPoolOverProvisioning(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	savedRatios := thinPoolRatios
+	defer func() { thinPoolRatios = savedRatios }()
+	if err := SetOverProvisionRatios([]string{"vgdata/pool0=2"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 20 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "pool0", vg: "vgdata", size: 10 * GBSIZE, thinPool: true}}
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	params := map[string]string{"vg": "vgdata", thinPoolKey: "pool0"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          fmt.Sprintf("pvc-%d", i),
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * GBSIZE},
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+				Parameters: params,
+			})
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("CreateVolume over the ratio should be ResourceExhausted, got %v", err)
+		}
+	}
+	if created != 4 {
+		t.Errorf("expect 4 volumes of 5G in a 10G pool with ratio 2, got %d", created)
+	}
+	resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: params})
+	if err != nil || resp.AvailableCapacity != 0 {
+		t.Errorf("full pool should have no capacity, got %v, %v", resp, err)
+	}
+
+	// growing a volume allocates the difference in the pool
+	vol := registry.listVolumes()[0]
+	if _, err := cs.expandVolume(vol.VolID, 6*GBSIZE); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expand over the ratio should be ResourceExhausted, got %v", err)
+	}
+	if err := SetOverProvisionRatios([]string{"vgdata/pool0=3"}); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := cs.expandVolume(vol.VolID, 10*GBSIZE); err != nil || size != 10*GBSIZE {
+		t.Errorf("expand within the ratio should grow to 10G, got %d, %v", size, err)
+	}
+	if _, err := cs.expandVolume(vol.VolID, 16*GBSIZE); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expand over the raised ratio should be ResourceExhausted, got %v", err)
+	}
+}
+
+// a lv can't span vg, the capacity is the free space of the largest candidate vg
+func TestCreateVolumeFromSource(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	savedRatios := thinPoolRatios
+	defer func() { thinPoolRatios = savedRatios }()
+	if err := SetOverProvisionRatios([]string{"vgdata/pool0=1.5"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 20 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "pool0", vg: "vgdata", size: 10 * GBSIZE, thinPool: true}}
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	request := func(name string, params map[string]string, source *csi.VolumeContentSource) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 4 * GBSIZE},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			Parameters:          params,
+			VolumeContentSource: source,
+		}
+	}
+	thin := map[string]string{"vg": "vgdata", thinPoolKey: "pool0"}
+	thick := map[string]string{"vg": "vgdata"}
+
+	src, err := cs.CreateVolume(context.Background(), request("pvc-src", thin, nil))
+	if err != nil {
+		t.Fatalf("CreateVolume error %v", err)
+	}
+	clone := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: src.Volume.VolumeId},
+	}}
+	// the clone of a thin volume is a thin snapshot in the pool of the source, whatever the class says
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-clone", thin, clone)); err != nil {
+		t.Fatalf("clone error %v", err)
+	}
+	resp, err := cs.CreateVolume(context.Background(), request("pvc-thick-clone", thick, clone))
+	if err != nil {
+		t.Fatalf("clone in a thick class error %v", err)
+	}
+	vol, _ := registry.getVolume(resp.Volume.VolumeId)
+	if vol.ThinPool != "pool0" {
+		t.Errorf("clone of a thin volume should be in pool0, got %q", vol.ThinPool)
+	}
+	if retry, err := cs.CreateVolume(context.Background(), request("pvc-thick-clone", thick, clone)); err != nil || retry.Volume.VolumeId != vol.VolID {
+		t.Errorf("retry of the clone should return volume %s, got %v, %v", vol.VolID, retry, err)
+	}
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-other-pool", map[string]string{"vg": "vgdata", thinPoolKey: "pool1"}, clone)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("clone into another pool should be InvalidArgument, got %v", err)
+	}
+	// 3 volumes of 4G are allocated in the pool of 10G with ratio 1.5
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-over", thick, clone)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("clone over the ratio should be ResourceExhausted, got %v", err)
+	}
+	snapshots := 0
+	for _, call := range fake.calls {
+		if strings.HasPrefix(call, "lvcreate -s -kn") {
+			snapshots++
+		}
+	}
+	if snapshots != 2 {
+		t.Errorf("expect 2 thin snapshots for the clones, got calls %v", fake.calls)
+	}
+
+	// the snapshot of the volume is copied into a new lv of the class
+	snap, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: src.Volume.VolumeId})
+	if err != nil {
+		t.Fatalf("CreateSnapshot error %v", err)
+	}
+	restored := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.Snapshot.SnapshotId},
+	}}
+	resp, err = cs.CreateVolume(context.Background(), request("pvc-restore", thick, restored))
+	if err != nil {
+		t.Fatalf("restore error %v", err)
+	}
+	vol, _ = registry.getVolume(resp.Volume.VolumeId)
+	if vol.ThinPool != "" || !strings.HasPrefix(fake.calls[len(fake.calls)-1], "dd if=/dev/vgdata/snap-") {
+		t.Errorf("restore in a thick class should copy the snapshot to a thick lv, got %+v, calls %v", vol, fake.calls)
+	}
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-restore-thin", thin, restored)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("restore over the ratio should be ResourceExhausted, got %v", err)
+	}
+	missing := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-unknown"},
+	}}
+	if _, err := cs.CreateVolume(context.Background(), request("pvc-missing", thick, missing)); status.Code(err) != codes.NotFound {
+		t.Errorf("restore of unknown snapshot should be NotFound, got %v", err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	for _, id := range []string{"id-1", "id-2"} {
+		vol := &lvmVolume{VolID: id, VolName: "pvc-" + id, VolumeGroup: "vgdata", LvmName: "csi-" + id, VolSize: GBSIZE, Bps: "0"}
+		fake.lvs = append(fake.lvs, &fakeLV{name: vol.LvmName, vg: "vgdata", size: GBSIZE})
+		registry.putVolume(vol)
+	}
+	create := func(name, source string) (*csi.CreateSnapshotResponse, error) {
+		return cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: source})
+	}
+
+	snap1, err := create("snap-1", "id-1")
+	if err != nil {
+		t.Fatalf("CreateSnapshot error %v", err)
+	}
+	if snap1.Snapshot.SizeBytes != GBSIZE || !snap1.Snapshot.ReadyToUse {
+		t.Errorf("snapshot should be ready with the size of the source, got %+v", snap1.Snapshot)
+	}
+	// the snapshot of the same name is returned again, another source is a conflict
+	retry, err := create("snap-1", "id-1")
+	if err != nil || retry.Snapshot.SnapshotId != snap1.Snapshot.SnapshotId {
+		t.Errorf("retry should return snapshot %s, got %v, %v", snap1.Snapshot.SnapshotId, retry, err)
+	}
+	if _, err := create("snap-1", "id-2"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("snapshot of the same name with another source should be AlreadyExists, got %v", err)
+	}
+	if _, err := create("snap-2", "id-unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("snapshot of unknown volume should be NotFound, got %v", err)
+	}
+	snap2, err := create("snap-2", "id-2")
+	if err != nil {
+		t.Fatalf("CreateSnapshot error %v", err)
+	}
+	if _, err := create("snap-3", "id-2"); err != nil {
+		t.Fatalf("CreateSnapshot error %v", err)
+	}
+	if len(fake.lvs) != 5 || len(registry.listSnapshots()) != 3 {
+		t.Errorf("expect 3 snapshot lvs, got %+v", fake.lvs)
+	}
+	state, err := loadState(stateFile)
+	if err != nil || len(state.Snapshots) != 3 {
+		t.Errorf("snapshots should be persisted, got %+v, %v", state, err)
+	}
+
+	list := func(req *csi.ListSnapshotsRequest) []string {
+		resp, err := cs.ListSnapshots(context.Background(), req)
+		if err != nil {
+			t.Fatalf("ListSnapshots error %v", err)
+		}
+		ids := []string{}
+		for _, e := range resp.Entries {
+			ids = append(ids, e.Snapshot.SnapshotId)
+		}
+		return ids
+	}
+	if ids := list(&csi.ListSnapshotsRequest{}); len(ids) != 3 {
+		t.Errorf("expect 3 snapshots, got %v", ids)
+	}
+	if ids := list(&csi.ListSnapshotsRequest{SourceVolumeId: "id-1"}); len(ids) != 1 || ids[0] != snap1.Snapshot.SnapshotId {
+		t.Errorf("expect snapshot %s of id-1, got %v", snap1.Snapshot.SnapshotId, ids)
+	}
+	if ids := list(&csi.ListSnapshotsRequest{SourceVolumeId: "id-2"}); len(ids) != 2 {
+		t.Errorf("expect 2 snapshots of id-2, got %v", ids)
+	}
+	if ids := list(&csi.ListSnapshotsRequest{SnapshotId: snap2.Snapshot.SnapshotId, SourceVolumeId: "id-1"}); len(ids) != 0 {
+		t.Errorf("snapshot of id-2 shouldn't be listed for id-1, got %v", ids)
+	}
+
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snap2.Snapshot.SnapshotId}); err != nil {
+		t.Fatalf("DeleteSnapshot error %v", err)
+	}
+	if _, ok := registry.getSnapshot(snap2.Snapshot.SnapshotId); ok || len(fake.lvs) != 4 {
+		t.Errorf("snapshot %s should be removed, got %+v", snap2.Snapshot.SnapshotId, fake.lvs)
+	}
+	// an unknown snapshot is deleted already
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap-unknown"}); err != nil {
+		t.Errorf("DeleteSnapshot of unknown snapshot should succeed, got %v", err)
+	}
+	if len(fake.lvs) != 4 {
+		t.Errorf("DeleteSnapshot of unknown snapshot shouldn't remove lvs, got %+v", fake.lvs)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	fake := newFakeLVM(nil,
+		&fakeVG{name: "vg1", size: 6 * GBSIZE, tags: []string{"ssd"}},
+		&fakeVG{name: "vg2", size: 4 * GBSIZE},
+		&fakeVG{name: "system", size: 20 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "data", vg: "vg1", size: GBSIZE}}
+	if err := SetVGFilter(nil, []string{"system"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetVGFilter(nil, nil)
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+
+	tests := []struct {
+		params map[string]string
+		expect int64
+	}{
+		{nil, 5 * GBSIZE},
+		{map[string]string{"vg": "vg2"}, 4 * GBSIZE},
+		{map[string]string{"vg": "vg1,vg2"}, 5 * GBSIZE},
+		{map[string]string{vgSelectorKey: "ssd"}, 5 * GBSIZE},
+		{map[string]string{"vg": "system"}, 0},
+	}
+	for _, test := range tests {
+		resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: test.params})
+		if err != nil || resp.AvailableCapacity != test.expect {
+			t.Errorf("capacity of %v expect %d, got %v, %v", test.params, test.expect, resp, err)
+		}
+	}
+}
+
+// the volumes are only created on the node named in the requisite topology
+func TestTopology(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	ns := &nodeServer{DefaultNodeServer: csicommon.NewDefaultNodeServer(d), exec: fake}
+	ctx := context.Background()
+	onNode := func(node string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{TopologyKey: node}}
+	}
+	request := func(name string, requisite ...*csi.Topology) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: GBSIZE},
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			AccessibilityRequirements: &csi.TopologyRequirement{Requisite: requisite},
+		}
+	}
+
+	info, err := ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil || info.NodeId != "node1" || info.AccessibleTopology.GetSegments()[TopologyKey] != "node1" {
+		t.Errorf("node should be accessible from itself, got %v, %v", info, err)
+	}
+
+	if _, err := cs.CreateVolume(ctx, request("pvc-1", onNode("node2"))); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateVolume for another node should be ResourceExhausted, got %v", err)
+	}
+	if len(fake.lvs) != 0 {
+		t.Errorf("no lv should be created for another node, got %+v", fake.lvs)
+	}
+	created, err := cs.CreateVolume(ctx, request("pvc-1", onNode("node2"), onNode("node1")))
+	if err != nil {
+		t.Fatalf("CreateVolume error %v", err)
+	}
+	if topology := created.Volume.AccessibleTopology; len(topology) != 1 || topology[0].GetSegments()[TopologyKey] != "node1" {
+		t.Errorf("volume should be accessible from node1, got %v", topology)
+	}
+
+	resp, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{AccessibleTopology: onNode("node2")})
+	if err != nil || resp.AvailableCapacity != 0 {
+		t.Errorf("another node should have no capacity, got %v, %v", resp, err)
+	}
+	resp, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{AccessibleTopology: onNode("node1")})
+	if err != nil || resp.AvailableCapacity != 9*GBSIZE {
+		t.Errorf("node1 should have %d bytes, got %v, %v", 9*GBSIZE, resp, err)
+	}
+}
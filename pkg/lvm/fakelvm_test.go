@@ -0,0 +1,410 @@
+package lvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+	utilexec "k8s.io/utils/exec"
+)
+
+type fakeVG struct {
+	name string
+	size int64
+	tags []string
+}
+
+type fakeLV struct {
+	name   string
+	vg     string
+	size   int64
+	tags   []string
+	pool   string
+	origin string
+	minor  int
+	// the lv is a thin pool, the thin lv in it have the pool set
+	thinPool bool
+	inactive bool
+}
+
+// fakeLVM emulates the commands run by the driver on an in-memory set of vg and lv
+type fakeLVM struct {
+	mu      sync.Mutex
+	vgs     []*fakeVG
+	lvs     []*fakeLV
+	nextLV  int
+	nextMin int
+	// device => filesystem made by mkfs
+	fs map[string]string
+	// findmnt answers from the mount points of the mounter
+	mounter *mount.FakeMounter
+	// the commands run, like "lvcreate -L 1G vgdata"
+	calls []string
+}
+
+func newFakeLVM(mounter *mount.FakeMounter, vgs ...*fakeVG) *fakeLVM {
+	return &fakeLVM{vgs: vgs, fs: map[string]string{}, mounter: mounter}
+}
+
+func (f *fakeLVM) Run(cmd string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, strings.Join(append([]string{cmd}, args...), " "))
+	switch cmd {
+	case "lvcreate":
+		return f.lvcreate(args)
+	case "lvremove":
+		return f.lvremove(args)
+	case "lvextend":
+		return f.lvextend(args)
+	case "lvchange":
+		return f.lvchange(args)
+	case "lvs":
+		return f.lvsReport(args)
+	case "vgs":
+		return f.vgsReport(args)
+	case "pvs":
+		return f.pvsReport(args)
+	case "blkid":
+		return f.blkid(args)
+	case "findmnt":
+		return f.findmnt(args)
+	case "mkfs.ext4", "mkfs.xfs":
+		f.fs[args[len(args)-1]] = strings.TrimPrefix(cmd, "mkfs.")
+		return nil, nil
+	case "fsck", "resize2fs", "xfs_growfs", "dd":
+		return nil, nil
+	case "blockdev":
+		return f.blockdev(args)
+	}
+	return nil, fmt.Errorf("fake lvm: unknown command %s", cmd)
+}
+
+func mapperPath(lv *fakeLV) string {
+	return lvMapperPath(lv.vg, lv.name)
+}
+
+func fail(code int, format string, a ...interface{}) ([]byte, error) {
+	msg := fmt.Sprintf(format, a...)
+	return []byte(msg), utilexec.CodeExitError{Err: errors.New(msg), Code: code}
+}
+
+func (f *fakeLVM) findVG(name string) *fakeVG {
+	for _, vg := range f.vgs {
+		if vg.name == name {
+			return vg
+		}
+	}
+	return nil
+}
+
+// find the lv by vg/lv or by its device path
+func (f *fakeLVM) findLV(path string) *fakeLV {
+	for _, lv := range f.lvs {
+		if path == lv.vg+"/"+lv.name || path == mapperPath(lv) || path == fmt.Sprintf("/dev/%s/%s", lv.vg, lv.name) {
+			return lv
+		}
+	}
+	return nil
+}
+
+func (f *fakeLVM) free(vg string) int64 {
+	free := f.findVG(vg).size
+	for _, lv := range f.lvs {
+		if lv.vg == vg && len(lv.pool) == 0 {
+			free -= lv.size
+		}
+	}
+	return free
+}
+
+// 500M, 2G
+func parseFakeSize(str string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(str, "M"):
+		unit = MBSIZE
+	case strings.HasSuffix(str, "G"):
+		unit = GBSIZE
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(str, "MG"), 10, 64)
+	return n * unit, err
+}
+
+func (f *fakeLVM) lvcreate(args []string) ([]byte, error) {
+	lv := &fakeLV{}
+	snapshot := false
+	var err error
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-L", "-V":
+			i++
+			if lv.size, err = parseFakeSize(args[i]); err != nil {
+				return fail(3, "invalid size %s", args[i])
+			}
+		case "--thinpool":
+			i++
+			lv.pool = args[i]
+		case "-n":
+			i++
+			lv.name = args[i]
+		case "--addtag":
+			i++
+			lv.tags = append(lv.tags, args[i])
+		case "-s":
+			snapshot = true
+		case "-kn", "-ay":
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				return fail(3, "unknown option %s", args[i])
+			}
+			lv.vg = args[i]
+		}
+	}
+	if snapshot {
+		origin := f.findLV(lv.vg)
+		if origin == nil {
+			return fail(5, "origin %s not found", lv.vg)
+		}
+		lv.vg = origin.vg
+		lv.origin = origin.name
+		// a thin snapshot takes the size and the pool of the origin
+		if lv.size == 0 {
+			lv.size = origin.size
+			lv.pool = origin.pool
+		}
+	}
+	if f.findVG(lv.vg) == nil {
+		return fail(5, "Volume group %q not found", lv.vg)
+	}
+	if len(lv.pool) == 0 && f.free(lv.vg) < lv.size {
+		return fail(5, "Volume group %q has insufficient free space", lv.vg)
+	}
+	if len(lv.name) == 0 {
+		lv.name = fmt.Sprintf("lvol%d", f.nextLV)
+		f.nextLV++
+	}
+	if f.findLV(lv.vg+"/"+lv.name) != nil {
+		return fail(5, "Logical Volume %q already exists in volume group %q", lv.name, lv.vg)
+	}
+	lv.minor = f.nextMin
+	f.nextMin++
+	f.lvs = append(f.lvs, lv)
+	return []byte(fmt.Sprintf("  Logical volume \"%s\" created.\n", lv.name)), nil
+}
+
+func (f *fakeLVM) lvremove(args []string) ([]byte, error) {
+	path := args[len(args)-1]
+	for i, lv := range f.lvs {
+		if lv == f.findLV(path) {
+			f.lvs = append(f.lvs[:i], f.lvs[i+1:]...)
+			return []byte(fmt.Sprintf("  Logical volume \"%s\" successfully removed\n", lv.name)), nil
+		}
+	}
+	return fail(5, "Failed to find logical volume %q", path)
+}
+
+func (f *fakeLVM) lvextend(args []string) ([]byte, error) {
+	lv := f.findLV(args[len(args)-1])
+	if lv == nil {
+		return fail(5, "Failed to find logical volume %q", args[len(args)-1])
+	}
+	size, err := parseFakeSize(args[1])
+	if err != nil {
+		return fail(3, "invalid size %s", args[1])
+	}
+	lv.size = size
+	return nil, nil
+}
+
+func (f *fakeLVM) lvchange(args []string) ([]byte, error) {
+	lv := f.findLV(args[len(args)-1])
+	if lv == nil {
+		return fail(5, "Failed to find logical volume %q", args[len(args)-1])
+	}
+	for i := 0; i < len(args)-1; i += 2 {
+		switch args[i] {
+		case "--deltag":
+			tags := lv.tags[:0]
+			for _, tag := range lv.tags {
+				if tag != args[i+1] {
+					tags = append(tags, tag)
+				}
+			}
+			lv.tags = tags
+		case "--addtag":
+			lv.tags = append(lv.tags, args[i+1])
+		}
+	}
+	return nil, nil
+}
+
+// the selection of the report, only vg_name="x" && lv_name="y" is supported
+func parseFakeSelection(args []string) (map[string]string, error) {
+	selection := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--reportformat", "--units", "-o":
+			i++
+		case "--nosuffix":
+		case "-S":
+			i++
+			for _, clause := range strings.Split(args[i], "&&") {
+				kv := strings.SplitN(strings.TrimSpace(clause), "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("invalid selection %q", args[i])
+				}
+				selection[kv[0]] = strings.Trim(kv[1], `"`)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected argument %q", args[i])
+		}
+	}
+	return selection, nil
+}
+
+func (f *fakeLVM) lvsReport(args []string) ([]byte, error) {
+	selection, err := parseFakeSelection(args)
+	if err != nil {
+		return fail(3, "%v", err)
+	}
+	lvs := []lvInfo{}
+	for _, lv := range f.lvs {
+		if vg, ok := selection["vg_name"]; ok && vg != lv.vg {
+			continue
+		}
+		if name, ok := selection["lv_name"]; ok && name != lv.name {
+			continue
+		}
+		attr := "-wi-a-----"
+		if lv.thinPool {
+			attr = "twi-aotz--"
+		} else if len(lv.pool) != 0 {
+			attr = "Vwi-a-tz--"
+		}
+		maj, min := "253", strconv.Itoa(lv.minor)
+		if lv.inactive {
+			attr = attr[:4] + "-" + attr[5:]
+			maj, min = "-1", "-1"
+		}
+		lvs = append(lvs, lvInfo{
+			LvName:      lv.name,
+			VgName:      lv.vg,
+			LvSize:      strconv.FormatInt(lv.size, 10),
+			LvTags:      strings.Join(lv.tags, ","),
+			LvKernelMaj: maj,
+			LvKernelMin: min,
+			LvAttr:      attr,
+			PoolLv:      lv.pool,
+			LvPath:      fmt.Sprintf("/dev/%s/%s", lv.vg, lv.name),
+			LvDmPath:    mapperPath(lv),
+		})
+	}
+	report := lvsReport{}
+	report.Report = append(report.Report, struct {
+		Lv []lvInfo `json:"lv"`
+	}{Lv: lvs})
+	return json.Marshal(report)
+}
+
+func (f *fakeLVM) vgsReport(args []string) ([]byte, error) {
+	if _, err := parseFakeSelection(args); err != nil {
+		return fail(3, "%v", err)
+	}
+	node := NodeLVMInfo{}
+	node.Report = append(node.Report, struct {
+		Vg []vgInfo `json:"vg"`
+	}{Vg: []vgInfo{}})
+	for _, vg := range f.vgs {
+		count := 0
+		for _, lv := range f.lvs {
+			if lv.vg == vg.name {
+				count++
+			}
+		}
+		node.Report[0].Vg = append(node.Report[0].Vg, vgInfo{
+			VgName:    vg.name,
+			PvCount:   "1",
+			LvCount:   strconv.Itoa(count),
+			SnapCount: "0",
+			VgAttr:    "wz--n-",
+			VgSize:    strconv.FormatInt(vg.size, 10),
+			VgFree:    strconv.FormatInt(f.free(vg.name), 10),
+			VgTags:    strings.Join(vg.tags, ","),
+		})
+	}
+	return json.Marshal(node)
+}
+
+// every vg has a single pv named after it
+func (f *fakeLVM) pvsReport(args []string) ([]byte, error) {
+	if _, err := parseFakeSelection(args); err != nil {
+		return fail(3, "%v", err)
+	}
+	report := pvsReport{}
+	report.Report = append(report.Report, struct {
+		Pv []PVInfo `json:"pv"`
+	}{Pv: []PVInfo{}})
+	for _, vg := range f.vgs {
+		report.Report[0].Pv = append(report.Report[0].Pv, PVInfo{
+			PvName: "/dev/pv-" + vg.name,
+			VgName: vg.name,
+			PvSize: strconv.FormatInt(vg.size, 10),
+			PvFree: strconv.FormatInt(f.free(vg.name), 10),
+			PvAttr: "a--",
+		})
+	}
+	return json.Marshal(report)
+}
+
+// the size of the device, or of the device bind mounted to the path
+func (f *fakeLVM) blockdev(args []string) ([]byte, error) {
+	device := args[len(args)-1]
+	if f.mounter != nil {
+		mps, _ := f.mounter.List()
+		for _, mp := range mps {
+			if mp.Path == device {
+				device = mp.Device
+			}
+		}
+	}
+	for _, lv := range f.lvs {
+		if device == mapperPath(lv) {
+			return []byte(fmt.Sprintf("%d\n", lv.size)), nil
+		}
+	}
+	return fail(1, "blockdev: cannot open %s: No such file or directory", device)
+}
+
+func (f *fakeLVM) blkid(args []string) ([]byte, error) {
+	fs, ok := f.fs[args[len(args)-1]]
+	if !ok {
+		return fail(2, "")
+	}
+	if args[len(args)-2] == "export" {
+		return []byte(fmt.Sprintf("DEVNAME=%s\nTYPE=%s\n", args[len(args)-1], fs)), nil
+	}
+	return []byte(fs + "\n"), nil
+}
+
+func (f *fakeLVM) findmnt(args []string) ([]byte, error) {
+	target := args[len(args)-1]
+	out := "TARGET PROPAGATION FSTYPE OPTIONS\n"
+	if f.mounter != nil {
+		mps, _ := f.mounter.List()
+		for _, mp := range mps {
+			if mp.Path == target && args[len(args)-2] == "SOURCE" {
+				return []byte(mp.Device + "\n"), nil
+			}
+			if mp.Path == target {
+				return []byte(out + fmt.Sprintf("%s private %s rw\n", target, mp.Type)), nil
+			}
+		}
+	}
+	// findmnt exits with 1 when nothing is found
+	return fail(1, "")
+}
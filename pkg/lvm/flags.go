@@ -0,0 +1,91 @@
+package lvm
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// the mount points whose vg is kept away from the volumes by default
+var systemMountPoints = []string{"/", "/boot"}
+
+// GetEnv returns the value of the environment variable, or the default if it is not set
+func GetEnv(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// SplitList splits the comma separated list, vg1, vg2 => [vg1 vg2]
+func SplitList(str string) []string {
+	items := []string{}
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// VGFilterFlags are the flags of the vg filter shared by the driver, lvmctl and the management api
+type VGFilterFlags struct {
+	include *string
+	exclude *string
+}
+
+// AddVGFilterFlags adds -include-vgs and -exclude-vgs to the flag set,
+// they default to the INCLUDE_VGS and EXCLUDE_VGS environment variables
+func AddVGFilterFlags(fs *flag.FlagSet) *VGFilterFlags {
+	return &VGFilterFlags{
+		include: fs.String("include-vgs", os.Getenv("INCLUDE_VGS"), "comma separated glob patterns of the vg to use, all vg if empty"),
+		exclude: fs.String("exclude-vgs", os.Getenv("EXCLUDE_VGS"), "comma separated glob patterns of the vg to ignore, the vg of / and /boot if empty"),
+	}
+}
+
+// Apply sets the vg filter from the flags
+// without exclude patterns the vg holding / and /boot are excluded, so the volumes never take the room of the system
+func (f *VGFilterFlags) Apply(exec mount.Exec) error {
+	exclude := SplitList(*f.exclude)
+	if len(exclude) == 0 {
+		vgs, err := systemVGs(exec)
+		if err != nil {
+			return fmt.Errorf("can't find the vg of the system, %v", err)
+		}
+		exclude = vgs
+	}
+	return SetVGFilter(SplitList(*f.include), exclude)
+}
+
+// the vg of the lv mounted at the system mount points
+// the mounts are read in the mount namespace the commands run in, which is the one of the host for the driver
+func systemVGs(exec mount.Exec) ([]string, error) {
+	lvs, err := listLVs(exec)
+	if err != nil {
+		return nil, err
+	}
+	vgs := []string{}
+	for _, mp := range systemMountPoints {
+		// findmnt exits with 1 when the path is not a mount point
+		out, err := execCommand(exec, "findmnt", []string{"-n", "-o", "SOURCE", mp})
+		if err != nil {
+			continue
+		}
+		// the source of a btrfs subvolume is like /dev/mapper/vg-root[/@]
+		source := strings.TrimSpace(string(out))
+		if idx := strings.Index(source, "["); idx >= 0 {
+			source = source[:idx]
+		}
+		for _, lv := range lvs {
+			if source == lv.LvPath || source == lv.LvDmPath {
+				glog.V(4).Infof("vg %s holds %s, exclude it", lv.VgName, mp)
+				vgs = append(vgs, lv.VgName)
+			}
+		}
+	}
+	return vgs, nil
+}
@@ -0,0 +1,462 @@
+package lvm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// the mount point of the cgroup filesystem, it is a variable for tests
+var cgroupRoot = "/sys/fs/cgroup"
+
+// the driver used to keep a cgroup per volume under this folder,
+// no process was attached to it so its limits throttled nothing
+const volumeCgroupFolder = "csi-lvm"
+
+// the pods folder of kubelet, it holds the target paths of the mounted volumes
+var kubeletPodsDir = "/var/lib/kubelet/pods"
+
+// kubelet publishes a block volume to <dir>/<pv>/<pod uid>
+var kubeletBlockPublishDir = "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish"
+
+// the major numbers of the block drivers, the lv are device-mapper devices
+var procDevices = "/proc/devices"
+
+// how often the rules of the devices the driver doesn't know are removed from the pods
+var cgroupSweepInterval = 10 * time.Minute
+
+// the limits in the parameters of the storage class
+const (
+	bpsKey       = "bps"
+	readBpsKey   = "readBps"
+	writeBpsKey  = "writeBps"
+	readIopsKey  = "readIops"
+	writeIopsKey = "writeIops"
+)
+
+// io limits of a device, 0 means unlimited
+type ioLimits struct {
+	ReadBps   uint64 `json:"read_bps"`
+	WriteBps  uint64 `json:"write_bps"`
+	ReadIops  uint64 `json:"read_iops"`
+	WriteIops uint64 `json:"write_iops"`
+}
+
+func (l ioLimits) empty() bool {
+	return l == ioLimits{}
+}
+
+// the limits of the volume
+// volumes created before the limits were introduced only have bps, which limits the writes
+func (lvm *lvmVolume) ioLimits() ioLimits {
+	if !lvm.Limits.empty() || len(lvm.Bps) == 0 {
+		return lvm.Limits
+	}
+	bps, err := parseIOLimit(lvm.Bps)
+	if err != nil {
+		glog.Warningf("volume %s has invalid bps %q, ignore it", lvm.VolID, lvm.Bps)
+	}
+	return ioLimits{WriteBps: bps}
+}
+
+// the limits of the storage class of the volume
+// volumes created before they were kept only know their current limits
+func (lvm *lvmVolume) classLimits() ioLimits {
+	if lvm.ClassLimits != nil {
+		return *lvm.ClassLimits
+	}
+	return lvm.ioLimits()
+}
+
+// parse the limits in the parameters of the storage class
+// bps is the old name of writeBps
+func parseIOLimits(params map[string]string) (ioLimits, error) {
+	limits := ioLimits{}
+	if _, err := limits.merge(params, ""); err != nil {
+		return ioLimits{}, err
+	}
+	return limits, nil
+}
+
+// override the limits by the prefixed keys found in values
+// return whether any key is found
+func (l *ioLimits) merge(values map[string]string, prefix string) (bool, error) {
+	keys := []struct {
+		key   string
+		value *uint64
+	}{
+		{bpsKey, &l.WriteBps},
+		{readBpsKey, &l.ReadBps},
+		{writeBpsKey, &l.WriteBps},
+		{readIopsKey, &l.ReadIops},
+		{writeIopsKey, &l.WriteIops},
+	}
+	found := false
+	for _, k := range keys {
+		str, ok := values[prefix+k.key]
+		if !ok {
+			continue
+		}
+		v, err := parseIOLimit(str)
+		if err != nil {
+			return found, fmt.Errorf("invalid %s %q, %v", k.key, str, err)
+		}
+		*k.value = v
+		found = true
+	}
+	return found, nil
+}
+
+// parse the quantity like 100Mi, 2k or 1048576
+func parseIOLimit(str string) (uint64, error) {
+	q, err := resource.ParseQuantity(strings.TrimSpace(str))
+	if err != nil {
+		return 0, err
+	}
+	if q.Sign() < 0 {
+		return 0, fmt.Errorf("negative limit")
+	}
+	return uint64(q.Value()), nil
+}
+
+// cgroup v2 has a single unified hierarchy with cgroup.controllers at the root
+func isCgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// the root of the hierarchy which holds the io controller
+func ioHierarchy() string {
+	if isCgroupV2() {
+		return cgroupRoot
+	}
+	return filepath.Join(cgroupRoot, "blkio")
+}
+
+// write the limits of the device to the cgroup dir
+func writeIOLimits(dir, maj, min string, limits ioLimits) error {
+	if len(maj) == 0 || len(min) == 0 {
+		return fmt.Errorf("device number is unknown")
+	}
+	device := fmt.Sprintf("%s:%s", maj, min)
+	if isCgroupV2() {
+		// io.max takes "max" for unlimited
+		value := func(v uint64) string {
+			if v == 0 {
+				return "max"
+			}
+			return strconv.FormatUint(v, 10)
+		}
+		line := fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", device,
+			value(limits.ReadBps), value(limits.WriteBps), value(limits.ReadIops), value(limits.WriteIops))
+		return writeCgroupFile(filepath.Join(dir, "io.max"), line)
+	}
+	// writing 0 to a v1 throttle file removes the rule of the device
+	files := []struct {
+		name  string
+		value uint64
+	}{
+		{"blkio.throttle.read_bps_device", limits.ReadBps},
+		{"blkio.throttle.write_bps_device", limits.WriteBps},
+		{"blkio.throttle.read_iops_device", limits.ReadIops},
+		{"blkio.throttle.write_iops_device", limits.WriteIops},
+	}
+	for _, f := range files {
+		if err := writeCgroupFile(filepath.Join(dir, f.name), fmt.Sprintf("%s %d", device, f.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCgroupFile(path, content string) error {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("write %q to %s error %v", content, path, err)
+	}
+	return nil
+}
+
+// the target path is like /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount
+// or /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/<pv>/<uid> for block volumes
+func podUIDFromTargetPath(targetPath string) string {
+	if strings.Contains(targetPath, "/volumeDevices/publish/") {
+		return filepath.Base(targetPath)
+	}
+	idx := strings.Index(targetPath, "/pods/")
+	if idx < 0 {
+		return ""
+	}
+	parts := strings.SplitN(targetPath[idx+len("/pods/"):], "/", 2)
+	return parts[0]
+}
+
+// stop walking the hierarchy once the pod is found
+var errPodCgroupFound = errors.New("pod cgroup found")
+
+// the cgroups of the pods in the kubepods hierarchy, the containers under them are skipped
+func listPodCgroups() ([]string, error) {
+	root := ioHierarchy()
+	dirs := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		depth := len(strings.Split(rel, string(filepath.Separator)))
+		name := info.Name()
+		switch {
+		case depth == 1 && !strings.HasPrefix(name, "kubepods"):
+			return filepath.SkipDir
+		case strings.HasPrefix(name, "pod") || strings.Contains(name, "-pod") && strings.HasSuffix(name, ".slice"):
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		case depth >= 3:
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// find the cgroup of the pod in the kubepods hierarchy
+// cgroupfs driver names it pod<uid>, systemd driver names it kubepods-<qos>-pod<uid with _>.slice
+func findPodCgroup(podUID string) (string, error) {
+	root := ioHierarchy()
+	cgroupfsName := "pod" + podUID
+	systemdSuffix := "-pod" + strings.Replace(podUID, "-", "_", -1) + ".slice"
+	found := ""
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		depth := len(strings.Split(rel, string(filepath.Separator)))
+		name := info.Name()
+		switch {
+		case depth == 1 && !strings.HasPrefix(name, "kubepods"):
+			return filepath.SkipDir
+		case name == cgroupfsName || strings.HasSuffix(name, systemdSuffix):
+			found = path
+			return errPodCgroupFound
+		case depth >= 3:
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && err != errPodCgroupFound {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("can't find cgroup of pod %s in %s", podUID, root)
+	}
+	return found, nil
+}
+
+// limit the io of the pod which the volume is published to
+func setPodLimits(lvm *lvmVolume, targetPath string) error {
+	limits := lvm.ioLimits()
+	if limits.empty() {
+		return nil
+	}
+	return writePodLimits(lvm, targetPath, limits)
+}
+
+// remove the limits of the volume from the pod it is unpublished from
+func clearPodLimits(lvm *lvmVolume, targetPath string) error {
+	return writePodLimits(lvm, targetPath, ioLimits{})
+}
+
+func writePodLimits(lvm *lvmVolume, targetPath string, limits ioLimits) error {
+	uid := podUIDFromTargetPath(targetPath)
+	if len(uid) == 0 {
+		return fmt.Errorf("can't find pod uid in %s", targetPath)
+	}
+	dir, err := findPodCgroup(uid)
+	if err != nil {
+		return err
+	}
+	if err := writeIOLimits(dir, lvm.Maj, lvm.Min, limits); err != nil {
+		return err
+	}
+	glog.V(4).Infof("set io limits %+v of volume %s in %s", limits, lvm.VolID, dir)
+	return nil
+}
+
+// the target paths of the pods on the node which the volume is published to
+func publishedTargetPaths(lvm *lvmVolume) []string {
+	paths := []string{}
+	for _, pattern := range []string{
+		filepath.Join(kubeletPodsDir, "*", "volumes", "kubernetes.io~csi", lvm.VolName, "mount"),
+		filepath.Join(kubeletBlockPublishDir, lvm.VolName, "*"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// write the current limits of the volume to the pods using it
+func rewriteVolumeLimits(lvm *lvmVolume) error {
+	for _, targetPath := range publishedTargetPaths(lvm) {
+		if err := writePodLimits(lvm, targetPath, lvm.ioLimits()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write the limits of the volumes to the pods using them again when the plugin restarts
+func reapplyVolumeLimits() {
+	for _, vol := range registry.listVolumes() {
+		if vol.ioLimits().empty() {
+			continue
+		}
+		if err := rewriteVolumeLimits(vol); err != nil {
+			glog.Errorf("can't reapply io limits of volume %s, %v", vol.VolID, err)
+		}
+	}
+}
+
+// the devices which have io rules in the cgroup dir, like 253:3
+func limitedDevices(dir string) ([]string, error) {
+	files := []string{"io.max"}
+	if !isCgroupV2() {
+		files = []string{"blkio.throttle.read_bps_device", "blkio.throttle.write_bps_device",
+			"blkio.throttle.read_iops_device", "blkio.throttle.write_iops_device"}
+	}
+	seen := map[string]bool{}
+	devices := []string{}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || seen[fields[0]] {
+				continue
+			}
+			seen[fields[0]] = true
+			devices = append(devices, fields[0])
+		}
+	}
+	return devices, nil
+}
+
+// the major number of device-mapper in /proc/devices
+func deviceMapperMajor() (string, error) {
+	f, err := os.Open(procDevices)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	block := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 2 && fields[0] == "Block" && fields[1] == "devices:":
+			block = true
+		case block && len(fields) == 2 && fields[1] == "device-mapper":
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("device-mapper is not in %s", procDevices)
+}
+
+// remove the rules of the lv which are not volumes of the driver from the cgroups of the pods,
+// like those left when the limits couldn't be cleared on unpublish and the volume was deleted since
+// only device-mapper devices are touched, the rules of the other disks are kept
+func sweepPodLimits() {
+	major, err := deviceMapperMajor()
+	if err != nil {
+		glog.Errorf("can't find major of device-mapper, %v", err)
+		return
+	}
+	known := map[string]bool{}
+	for _, vol := range registry.listVolumes() {
+		known[vol.Maj+":"+vol.Min] = true
+	}
+	dirs, err := listPodCgroups()
+	if err != nil {
+		glog.Errorf("can't list pod cgroups, %v", err)
+		return
+	}
+	for _, dir := range dirs {
+		devices, err := limitedDevices(dir)
+		if err != nil {
+			glog.Errorf("can't read io rules of %s, %v", dir, err)
+			continue
+		}
+		for _, device := range devices {
+			parts := strings.SplitN(device, ":", 2)
+			if len(parts) != 2 || parts[0] != major || known[device] {
+				continue
+			}
+			if err := writeIOLimits(dir, parts[0], parts[1], ioLimits{}); err != nil {
+				glog.Errorf("can't remove stale io rules of %s in %s, %v", device, dir, err)
+				continue
+			}
+			glog.V(4).Infof("remove stale io rules of %s in %s", device, dir)
+		}
+	}
+}
+
+// sweep the cgroups until stop is closed
+// the old layout is removed once, the stale rules in the pods every cgroupSweepInterval
+func runCgroupSweeper(stop <-chan struct{}) {
+	sweepVolumeCgroups()
+	for {
+		select {
+		case <-time.After(cgroupSweepInterval):
+			sweepPodLimits()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// remove the cgroups left under the csi-lvm folder by the earlier versions of the driver,
+// none of them is used since the limits are written to the cgroups of the pods
+func sweepVolumeCgroups() {
+	root := filepath.Join(ioHierarchy(), volumeCgroupFolder)
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("can't list volume cgroups in %s, %v", root, err)
+		}
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, info.Name())
+		if err := os.Remove(dir); err != nil {
+			glog.Errorf("can't remove stale cgroup %s, %v", dir, err)
+			continue
+		}
+		glog.V(4).Infof("remove stale cgroup %s", dir)
+	}
+	if err := os.Remove(root); err != nil {
+		glog.Errorf("can't remove stale cgroup %s, %v", root, err)
+	}
+}
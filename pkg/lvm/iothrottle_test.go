@@ -0,0 +1,152 @@
+package lvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withCgroupRoot(t *testing.T, v2 bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "csi-lvm-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 {
+		ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("io memory"), 0644)
+	}
+	saved := cgroupRoot
+	cgroupRoot = dir
+	return dir, func() {
+		cgroupRoot = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWriteIOLimits(t *testing.T) {
+	dir, cleanup := withCgroupRoot(t, true)
+	defer cleanup()
+	limits := ioLimits{ReadBps: 100, WriteIops: 20}
+	if err := writeIOLimits(dir, "253", "3", limits); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "io.max"))
+	if expect := "253:3 rbps=100 wbps=max riops=max wiops=20"; string(data) != expect {
+		t.Errorf("expect io.max %q, got %q", expect, string(data))
+	}
+
+	dir, cleanup = withCgroupRoot(t, false)
+	defer cleanup()
+	if err := writeIOLimits(dir, "253", "3", limits); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "blkio.throttle.read_bps_device"))
+	if expect := "253:3 100"; string(data) != expect {
+		t.Errorf("expect read_bps_device %q, got %q", expect, string(data))
+	}
+	if err := writeIOLimits(dir, "", "", limits); err == nil {
+		t.Error("unknown device number should be rejected")
+	}
+}
+
+func TestFindPodCgroup(t *testing.T) {
+	uid := "0f1c1c32-5b5e-11e9-8647-d663bd873d93"
+	targetPath := "/var/lib/kubelet/pods/" + uid + "/volumes/kubernetes.io~csi/pvc-1/mount"
+	if got := podUIDFromTargetPath(targetPath); got != uid {
+		t.Fatalf("expect pod uid %s, got %s", uid, got)
+	}
+	blockPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/" + uid
+	if got := podUIDFromTargetPath(blockPath); got != uid {
+		t.Fatalf("expect pod uid %s of block volume, got %s", uid, got)
+	}
+	for _, rel := range []string{
+		"kubepods/burstable/pod" + uid,
+		"kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + strings.Replace(uid, "-", "_", -1) + ".slice",
+	} {
+		dir, cleanup := withCgroupRoot(t, true)
+		os.MkdirAll(filepath.Join(dir, "system.slice", "pod"+uid), 0755)
+		os.MkdirAll(filepath.Join(dir, rel), 0755)
+		got, err := findPodCgroup(uid)
+		if err != nil || got != filepath.Join(dir, rel) {
+			t.Errorf("expect %s, got %s, %v", rel, got, err)
+		}
+		cleanup()
+	}
+}
+
+func TestParseIOLimits(t *testing.T) {
+	limits, err := parseIOLimits(map[string]string{
+		"bps":       "1048576",
+		"readBps":   "100Mi",
+		"readIops":  "2k",
+		"writeIops": "500",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := ioLimits{ReadBps: 100 * MBSIZE, WriteBps: MBSIZE, ReadIops: 2000, WriteIops: 500}
+	if limits != expect {
+		t.Errorf("expect %+v, got %+v", expect, limits)
+	}
+	limits, _ = parseIOLimits(map[string]string{"bps": "1Mi", "writeBps": "2Mi"})
+	if limits.WriteBps != 2*MBSIZE {
+		t.Errorf("writeBps should override bps, got %d", limits.WriteBps)
+	}
+	for _, v := range []string{"abc", "-1Mi"} {
+		if _, err := parseIOLimits(map[string]string{"readBps": v}); err == nil {
+			t.Errorf("readBps %q should be rejected", v)
+		}
+	}
+	vol := &lvmVolume{Bps: "4096"}
+	if got := vol.ioLimits(); got.WriteBps != 4096 {
+		t.Errorf("bps of old volume should limit writes, got %+v", got)
+	}
+}
+
+func TestSweepVolumeCgroups(t *testing.T) {
+	dir, cleanup := withCgroupRoot(t, true)
+	defer cleanup()
+	// the old layout named the cgroups after the volume, the placeholders had none
+	root := filepath.Join(dir, volumeCgroupFolder)
+	os.MkdirAll(filepath.Join(root, "pvc-1"), 0755)
+	os.MkdirAll(filepath.Join(root, "pvc-2"), 0755)
+	sweepVolumeCgroups()
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("cgroups of the old layout should be removed, got %v", err)
+	}
+	// nothing to sweep
+	sweepVolumeCgroups()
+}
+
+func TestSweepPodLimits(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	dir, cleanup := withCgroupRoot(t, true)
+	defer cleanup()
+	saved := procDevices
+	defer func() { procDevices = saved }()
+	procDevices = filepath.Join(dir, "devices")
+	ioutil.WriteFile(procDevices, []byte("Character devices:\n  1 mem\n253 ttyS\n\nBlock devices:\n  8 sd\n253 device-mapper\n"), 0644)
+	registry.putVolume(&lvmVolume{VolID: "id-1", VolName: "pvc-1", Maj: "253", Min: "3"})
+
+	// 253:5 was a volume deleted since, 8:0 is a disk the driver doesn't own
+	pod := filepath.Join(dir, "kubepods", "burstable", "pod0f1c1c32-5b5e-11e9-8647-d663bd873d93")
+	os.MkdirAll(pod, 0755)
+	ioutil.WriteFile(filepath.Join(pod, "io.max"), []byte("253:5 rbps=max wbps=1048576 riops=max wiops=max\n"+
+		"253:3 rbps=max wbps=1048576 riops=max wiops=max\n8:0 rbps=100 wbps=max riops=max wiops=max\n"), 0644)
+	other := filepath.Join(dir, "system.slice", "pod-other")
+	os.MkdirAll(other, 0755)
+	ioutil.WriteFile(filepath.Join(other, "io.max"), []byte("253:5 rbps=max wbps=1048576 riops=max wiops=max\n"), 0644)
+
+	sweepPodLimits()
+	// the rules are written one device at a time, only the stale one is written
+	data, _ := ioutil.ReadFile(filepath.Join(pod, "io.max"))
+	if expect := "253:5 rbps=max wbps=max riops=max wiops=max"; string(data) != expect {
+		t.Errorf("expect rules of 253:5 removed only, got %q", string(data))
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(other, "io.max"))
+	if !strings.Contains(string(data), "wbps=1048576") {
+		t.Errorf("cgroups out of kubepods shouldn't be touched, got %q", string(data))
+	}
+}
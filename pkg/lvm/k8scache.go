@@ -4,17 +4,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/golang/glog"
+	v1alpha1 "github.com/tommenx/csi-lvm-plugin/pkg/apis/lvmnode/v1alpha1"
+	lvmclient "github.com/tommenx/csi-lvm-plugin/pkg/client/clientset/versioned/typed/lvmnode/v1alpha1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8s "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// ConfigCache reports the lvm storage of the node in its LVMNode
+// the configmap csi-lvm-<node> used before is only read to migrate the allocation
 type ConfigCache struct {
-	Client    *k8s.Clientset
+	Client    k8s.Interface
+	LVMClient lvmclient.LVMNodesGetter
 	Namespace string
 	NodeID    string
 }
@@ -24,6 +31,8 @@ const (
 	defaultNID   = "zx"
 	cmLabel      = "createdBy"
 	cmLabelValue = "lvm-csi"
+	// times to retry the update of the status on conflict
+	updateRetries = 3
 )
 
 func GetNodeID() string {
@@ -36,9 +45,19 @@ func GetNodeID() string {
 }
 func NewConfigCache() *ConfigCache {
 	ns := GetNamespace()
-	clientset := NewK8sClient()
+	cfg := newK8sConfig()
+	clientset, err := k8s.NewForConfig(cfg)
+	if err != nil {
+		glog.Errorf("Failed to create client with error: %v\n", err)
+		os.Exit(1)
+	}
+	lvmClient, err := lvmclient.NewForConfig(cfg)
+	if err != nil {
+		glog.Errorf("Failed to create lvmnode client with error: %v\n", err)
+		os.Exit(1)
+	}
 	nid := GetNodeID()
-	return &ConfigCache{clientset, ns, nid}
+	return &ConfigCache{clientset, lvmClient, ns, nid}
 }
 
 func GetNamespace() string {
@@ -51,6 +70,16 @@ func GetNamespace() string {
 
 // create a kubernetes client
 func NewK8sClient() *k8s.Clientset {
+	client, err := k8s.NewForConfig(newK8sConfig())
+	if err != nil {
+		glog.Errorf("Failed to create client with error: %v\n", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// the config of the kubernetes clients
+func newK8sConfig() *rest.Config {
 	var cfg *rest.Config
 	var err error
 	// cPath := os.Getenv("KUBERNETES_CONFIG_PATH")
@@ -68,16 +97,11 @@ func NewK8sClient() *k8s.Clientset {
 			os.Exit(1)
 		}
 	}
-	client, err := k8s.NewForConfig(cfg)
-	if err != nil {
-		glog.Errorf("Failed to create client with error: %v\n", err)
-		os.Exit(1)
-	}
-	return client
+	return cfg
 }
 
-// get a configmap by given the name
-func (cache *ConfigCache) Get() (*v1.ConfigMap, error) {
+// get the configmap of the node written by the older versions of the plugin
+func (cache *ConfigCache) getConfigMap() (*v1.ConfigMap, error) {
 	resourceID := fmt.Sprintf("csi-lvm-%s", cache.NodeID)
 	cm, err := cache.Client.CoreV1().ConfigMaps(cache.Namespace).Get(resourceID, metav1.GetOptions{})
 	if err != nil {
@@ -86,64 +110,167 @@ func (cache *ConfigCache) Get() (*v1.ConfigMap, error) {
 	return cm, nil
 }
 
-// create configmap if it not exist
-// 1. check if exist
-// 2. create configmap, and double check if it is exist
-// 3. update the configmap data
+// get the LVMNode of the node
+func (cache *ConfigCache) Get() (*v1alpha1.LVMNode, error) {
+	return cache.LVMClient.LVMNodes().Get(cache.NodeID, metav1.GetOptions{})
+}
+
+// create the LVMNode if it not exist
+// 1. check if exist, a node which already has allocations is left to Update
+// 2. create the LVMNode
+// 3. report the node info, and the allocation of the old configmap if there is one,
+// also into a LVMNode left without allocations by the older versions
 func (cache *ConfigCache) Create(data interface{}) error {
-	identifier := fmt.Sprintf("csi-lvm-%s", cache.NodeID)
-	cm, err := cache.Get()
-	if cm != nil && err == nil {
-		glog.V(4).Infof("configmap %s already exist", identifier)
-		return nil
+	node, err := cache.Get()
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("lvmnode get error %v", err)
 	}
-	jsonStr, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("configmap convert to json error")
-	}
-	cm = &v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      identifier,
-			Namespace: cache.Namespace,
-			Labels: map[string]string{
-				cmLabel: cmLabelValue,
+	if err == nil {
+		glog.V(4).Infof("lvmnode %s already exist", node.Name)
+		if len(node.Status.Allocations) != 0 {
+			return nil
+		}
+	} else {
+		node = &v1alpha1.LVMNode{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: cache.NodeID,
+				Labels: map[string]string{
+					cmLabel: cmLabelValue,
+				},
 			},
-		},
-		Data: map[string]string{},
+			Spec: v1alpha1.LVMNodeSpec{NodeID: cache.NodeID},
+		}
+		if node, err = cache.LVMClient.LVMNodes().Create(node); err != nil {
+			return fmt.Errorf("lvmnode create error %v", err)
+		}
 	}
-	cm.Data["node"] = string(jsonStr)
-	cm.Data["allocation"] = ""
-	_, err = cache.Client.CoreV1().ConfigMaps(cache.Namespace).Create(cm)
-	if err != nil {
-		return fmt.Errorf("configmap create error %v", err)
+	if allocation, ok := cache.legacyAllocation(); ok {
+		node.Status.Allocations = allocationsStatus(allocation)
+	}
+	setNodeStatus(&node.Status, data)
+	if _, err := cache.LVMClient.LVMNodes().UpdateStatus(node); err != nil {
+		return fmt.Errorf("lvmnode update status error %v", err)
 	}
 	return nil
 }
 
-// update node info of config map
-func (cache *ConfigCache) Update(data interface{}) error {
-	identifier := fmt.Sprintf("csi-lvm-%s", cache.NodeID)
-	cm, err := cache.Get()
+// the allocation in the configmap of the older versions of the plugin
+func (cache *ConfigCache) legacyAllocation() (AllocationsLVM, bool) {
+	allocation := AllocationsLVM{}
+	cm, err := cache.getConfigMap()
 	if err != nil {
-		glog.Errorf("Configmap update error,%v", err)
-		return err
+		return allocation, false
 	}
-	jsonStr, err := json.Marshal(data)
-	if err != nil {
-		glog.Errorf("Configmap convert to JSON error,%v", err)
-		return err
+	str := cm.Data["allocation"]
+	if len(str) == 0 {
+		return allocation, false
+	}
+	if err := json.Unmarshal([]byte(str), &allocation); err != nil {
+		glog.Errorf("can't parse allocation of configmap %s, %v", cm.Name, err)
+		return allocation, false
+	}
+	glog.V(4).Infof("migrate %d volumes from configmap %s", len(allocation.Allocation), cm.Name)
+	return allocation, true
+}
+
+// update the node info or the allocation in the status of the LVMNode
+// the status is read again and retried when it is changed by others in the meantime
+func (cache *ConfigCache) Update(data interface{}) error {
+	var err error
+	for i := 0; i < updateRetries; i++ {
+		var node *v1alpha1.LVMNode
+		node, err = cache.Get()
+		if err != nil {
+			glog.Errorf("lvmnode update error, %v", err)
+			return err
+		}
+		setNodeStatus(&node.Status, data)
+		if _, err = cache.LVMClient.LVMNodes().UpdateStatus(node); err == nil {
+			glog.V(4).Infof("update lvmnode %s success", node.Name)
+			return nil
+		}
+		if !apierrors.IsConflict(err) {
+			break
+		}
 	}
-	switch data.(type) {
+	glog.Errorf("lvmnode update error, %v", err)
+	return err
+}
+
+// put the node info or the allocation into the status
+func setNodeStatus(status *v1alpha1.LVMNodeStatus, data interface{}) {
+	switch d := data.(type) {
 	case NodeLVMInfo:
-		cm.Data["node"] = string(jsonStr)
+		status.VolumeGroups = volumeGroupsStatus(&d)
+		status.ThinPools = thinPoolsStatus(&d)
+	case *NodeLVMInfo:
+		if d != nil {
+			status.VolumeGroups = volumeGroupsStatus(d)
+			status.ThinPools = thinPoolsStatus(d)
+		}
 	case AllocationsLVM:
-		cm.Data["allocation"] = string(jsonStr)
+		status.Allocations = allocationsStatus(d)
 	}
-	_, err = cache.Client.CoreV1().ConfigMaps(cache.Namespace).Update(cm)
-	if err != nil {
-		glog.Error("Configmap create error")
-		return err
+	status.UpdateTime = metav1.Now()
+}
+
+func volumeGroupsStatus(node *NodeLVMInfo) []v1alpha1.VolumeGroup {
+	vgs := []v1alpha1.VolumeGroup{}
+	for _, r := range node.Report {
+		for _, vg := range r.Vg {
+			// the report is in bytes without suffix
+			size, _ := strconv.ParseInt(vg.VgSize, 10, 64)
+			free, _ := strconv.ParseInt(vg.VgFree, 10, 64)
+			pvCount, _ := strconv.ParseInt(vg.PvCount, 10, 64)
+			lvCount, _ := strconv.ParseInt(vg.LvCount, 10, 64)
+			vgs = append(vgs, v1alpha1.VolumeGroup{
+				Name:    vg.VgName,
+				Size:    size,
+				Free:    free,
+				PvCount: pvCount,
+				LvCount: lvCount,
+				Tags:    SplitList(vg.VgTags),
+			})
+		}
 	}
-	glog.V(4).Infof("update configmap %s success", identifier)
-	return nil
+	return vgs
+}
+
+// the thin pools in the allowed vg
+func thinPoolsStatus(node *NodeLVMInfo) []v1alpha1.ThinPool {
+	pools := []v1alpha1.ThinPool{}
+	for i := range node.thinPools {
+		lv := &node.thinPools[i]
+		size, _ := strconv.ParseInt(lv.LvSize, 10, 64)
+		pools = append(pools, v1alpha1.ThinPool{
+			Name:        lv.LvName,
+			VolumeGroup: lv.VgName,
+			Size:        size,
+			DataPercent: lv.DataPercent,
+		})
+	}
+	return pools
+}
+
+func allocationsStatus(allocation AllocationsLVM) []v1alpha1.Allocation {
+	allocations := []v1alpha1.Allocation{}
+	for i := range allocation.Allocation {
+		vol := &allocation.Allocation[i]
+		limits := vol.ioLimits()
+		allocations = append(allocations, v1alpha1.Allocation{
+			VolID:       vol.VolID,
+			VolName:     vol.VolName,
+			VolumeGroup: vol.VolumeGroup,
+			LvmName:     vol.LvmName,
+			ThinPool:    vol.ThinPool,
+			Size:        vol.VolSize,
+			Limits: v1alpha1.IOLimits{
+				ReadBps:   limits.ReadBps,
+				WriteBps:  limits.WriteBps,
+				ReadIops:  limits.ReadIops,
+				WriteIops: limits.WriteIops,
+			},
+		})
+	}
+	return allocations
 }
@@ -0,0 +1,180 @@
+package lvm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tommenx/csi-lvm-plugin/pkg/apis/lvmnode/v1alpha1"
+	lvmclient "github.com/tommenx/csi-lvm-plugin/pkg/client/clientset/versioned/typed/lvmnode/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+func TestSetNodeStatus(t *testing.T) {
+	node := NodeLVMInfo{}
+	out := `{"report": [{"vg": [{"vg_name":"vgdata", "pv_count":"1", "lv_count":"2", "snap_count":"0",
+		"vg_attr":"wz--n-", "vg_size":"107369988096", "vg_free":"85895151616", "vg_tags":"ssd,zone-a"}]}]}`
+	if err := json.Unmarshal([]byte(out), &node); err != nil {
+		t.Fatal(err)
+	}
+	status := v1alpha1.LVMNodeStatus{}
+	status.VolumeGroups = volumeGroupsStatus(&node)
+	expect := []v1alpha1.VolumeGroup{{Name: "vgdata", Size: 107369988096, Free: 85895151616, PvCount: 1, LvCount: 2, Tags: []string{"ssd", "zone-a"}}}
+	if !reflect.DeepEqual(status.VolumeGroups, expect) {
+		t.Errorf("expect %+v, got %+v", expect, status.VolumeGroups)
+	}
+
+	setNodeStatus(&status, AllocationsLVM{Allocation: []lvmVolume{
+		{VolName: "pvc-1", LvmName: "lvol0", VolID: "id-1", VolumeGroup: "vgdata", Bps: "1024", VolSize: GBSIZE},
+	}})
+	allocations := []v1alpha1.Allocation{
+		{VolID: "id-1", VolName: "pvc-1", VolumeGroup: "vgdata", LvmName: "lvol0", Size: GBSIZE, Limits: v1alpha1.IOLimits{WriteBps: 1024}},
+	}
+	if !reflect.DeepEqual(status.Allocations, allocations) {
+		t.Errorf("expect %+v, got %+v", allocations, status.Allocations)
+	}
+	if !reflect.DeepEqual(status.VolumeGroups, expect) {
+		t.Errorf("allocation should not change the volume groups, got %+v", status.VolumeGroups)
+	}
+	if status.UpdateTime.IsZero() {
+		t.Errorf("update time should be set")
+	}
+}
+
+// fakeClient serves the configmaps of the older versions, the other methods are not implemented
+type fakeClient struct {
+	k8s.Interface
+	configMaps map[string]*v1.ConfigMap
+}
+
+type fakeCoreV1 struct {
+	corev1.CoreV1Interface
+	client *fakeClient
+}
+
+type fakeConfigMaps struct {
+	corev1.ConfigMapInterface
+	client *fakeClient
+}
+
+func (f *fakeClient) CoreV1() corev1.CoreV1Interface {
+	return &fakeCoreV1{client: f}
+}
+
+func (f *fakeCoreV1) ConfigMaps(namespace string) corev1.ConfigMapInterface {
+	return &fakeConfigMaps{client: f.client}
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	cm, ok := f.client.configMaps[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), name)
+	}
+	return cm, nil
+}
+
+// fakeLVMNodes keeps the LVMNode in memory, the other methods are not implemented
+type fakeLVMNodes struct {
+	lvmclient.LVMNodeInterface
+	nodes map[string]*v1alpha1.LVMNode
+}
+
+func (f *fakeLVMNodes) LVMNodes() lvmclient.LVMNodeInterface {
+	return f
+}
+
+func (f *fakeLVMNodes) Get(name string, options metav1.GetOptions) (*v1alpha1.LVMNode, error) {
+	node, ok := f.nodes[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1alpha1.Resource("lvmnodes"), name)
+	}
+	return node.DeepCopy(), nil
+}
+
+func (f *fakeLVMNodes) Create(node *v1alpha1.LVMNode) (*v1alpha1.LVMNode, error) {
+	if _, ok := f.nodes[node.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(v1alpha1.Resource("lvmnodes"), node.Name)
+	}
+	f.nodes[node.Name] = node.DeepCopy()
+	return node, nil
+}
+
+func (f *fakeLVMNodes) UpdateStatus(node *v1alpha1.LVMNode) (*v1alpha1.LVMNode, error) {
+	if _, ok := f.nodes[node.Name]; !ok {
+		return nil, apierrors.NewNotFound(v1alpha1.Resource("lvmnodes"), node.Name)
+	}
+	f.nodes[node.Name] = node.DeepCopy()
+	return node, nil
+}
+
+func TestCreateMigratesConfigMap(t *testing.T) {
+	client := &fakeClient{configMaps: map[string]*v1.ConfigMap{
+		"csi-lvm-node1": {Data: map[string]string{"allocation": `{"allocation": [
+			{"vol_id": "id-1", "vol_name": "pvc-1", "volume_group": "vgdata", "lvm_name": "lvol0", "bps": "1024", "volume_size": 1073741824},
+			{"vol_id": "id-3", "vol_name": "pvc-3", "volume_group": "vgdata", "lvm_name": "lvol1", "bps": "0", "volume_size": 1073741824}]}`}},
+	}}
+	migrated := []v1alpha1.Allocation{
+		{VolID: "id-1", VolName: "pvc-1", VolumeGroup: "vgdata", LvmName: "lvol0", Size: GBSIZE, Limits: v1alpha1.IOLimits{WriteBps: 1024}},
+		{VolID: "id-3", VolName: "pvc-3", VolumeGroup: "vgdata", LvmName: "lvol1", Size: GBSIZE},
+	}
+	kept := []v1alpha1.Allocation{{VolID: "id-2", VolName: "pvc-2", VolumeGroup: "vgdata", Size: GBSIZE}}
+	tests := []struct {
+		name   string
+		node   *v1alpha1.LVMNode
+		expect []v1alpha1.Allocation
+	}{
+		{"new node", nil, migrated},
+		{"node without allocations", &v1alpha1.LVMNode{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, migrated},
+		{"node with allocations", &v1alpha1.LVMNode{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Status:     v1alpha1.LVMNodeStatus{Allocations: kept},
+		}, kept},
+	}
+	for _, test := range tests {
+		nodes := &fakeLVMNodes{nodes: map[string]*v1alpha1.LVMNode{}}
+		if test.node != nil {
+			nodes.nodes["node1"] = test.node
+		}
+		cache := &ConfigCache{Client: client, LVMClient: nodes, Namespace: "default", NodeID: "node1"}
+		if err := cache.Create(NodeLVMInfo{}); err != nil {
+			t.Errorf("%s: create error %v", test.name, err)
+			continue
+		}
+		node, ok := nodes.nodes["node1"]
+		if !ok {
+			t.Errorf("%s: lvmnode should be created", test.name)
+			continue
+		}
+		if !reflect.DeepEqual(node.Status.Allocations, test.expect) {
+			t.Errorf("%s: expect allocations %+v, got %+v", test.name, test.expect, node.Status.Allocations)
+		}
+	}
+
+	// the driver imports the volumes of the configmap whose lv is still there,
+	// so the allocation written on the next change keeps them
+	_, restore := withTestState(t)
+	defer restore()
+	nodes := &fakeLVMNodes{nodes: map[string]*v1alpha1.LVMNode{}}
+	cache := &ConfigCache{Client: client, LVMClient: nodes, Namespace: "default", NodeID: "node1"}
+	if err := cache.Create(NodeLVMInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "lvol0", vg: "vgdata", size: GBSIZE}}
+	cs := &controllerServer{k8sCache: cache, nodeID: "node1", exec: fake}
+	cs.importLegacyVolumes()
+	if err := persistState(); err != nil {
+		t.Fatal(err)
+	}
+	cs.updateCache()
+	if allocations := nodes.nodes["node1"].Status.Allocations; !reflect.DeepEqual(allocations, migrated[:1]) {
+		t.Errorf("expect allocations %+v after update, got %+v", migrated[:1], allocations)
+	}
+	if state, err := loadState(stateFile); err != nil || len(state.Volumes) != 1 || state.Volumes[0].VolID != "id-1" {
+		t.Errorf("id-1 should be journaled, got %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,228 @@
+package lvm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// create, stage, publish, expand, unpublish, unstage and delete a volume on the fake lvm
+func TestVolumeLifecycle(t *testing.T) {
+	cgroup, restoreCgroup := withCgroupRoot(t, false)
+	defer restoreCgroup()
+	dir, restore := withTestState(t)
+	defer restore()
+
+	podUID := "8a5a7b2e-1111-2222-3333-444455556666"
+	stagingPath := filepath.Join(dir, "globalmount")
+	targetPath := filepath.Join(dir, "pods", podUID, "volumes", "kubernetes.io~csi", "pvc-1", "mount")
+	podCgroup := filepath.Join(cgroup, "blkio", "kubepods", "pod"+podUID)
+	for _, p := range []string{stagingPath, targetPath, podCgroup} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mounter := &mount.FakeMounter{Filesystem: map[string]mount.FileType{
+		stagingPath: mount.FileTypeDirectory,
+		targetPath:  mount.FileTypeDirectory,
+	}}
+	fake := newFakeLVM(mounter, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	ns := &nodeServer{DefaultNodeServer: csicommon.NewDefaultNodeServer(d), mounter: mounter, exec: fake}
+	ctx := context.Background()
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	created, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: GBSIZE},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         map[string]string{"vg": "vgdata", writeBpsKey: "10Mi"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume error %v", err)
+	}
+	volumeId := created.Volume.VolumeId
+	if len(fake.lvs) != 1 || fake.lvs[0].size != GBSIZE || created.Volume.VolumeContext["vg"] != "vgdata" {
+		t.Fatalf("unexpected lv %+v for volume %v", fake.lvs, created.Volume)
+	}
+	vol, ok := registry.getVolume(volumeId)
+	if !ok || vol.LvmName != fake.lvs[0].name || vol.Maj != "253" || vol.Min != "0" {
+		t.Fatalf("unexpected volume %+v", vol)
+	}
+	if got := volumeFromLV(&lvInfo{LvName: vol.LvmName, VgName: "vgdata", LvTags: strings.Join(fake.lvs[0].tags, ",")}); got == nil || got.VolID != volumeId {
+		t.Errorf("lv should be tagged with the volume, got %+v", got)
+	}
+	// the fake mounter mounts without formatting, so the filesystem is made here
+	fake.fs[vol.MapperPath] = "ext4"
+
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId: volumeId, StagingTargetPath: stagingPath, VolumeCapability: capability,
+	}); err != nil {
+		t.Fatalf("NodeStageVolume error %v", err)
+	}
+	if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId: volumeId, StagingTargetPath: stagingPath, TargetPath: targetPath, VolumeCapability: capability,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume error %v", err)
+	}
+	mps, _ := mounter.List()
+	if len(mps) != 2 || mps[0].Device != vol.MapperPath || mps[1].Device != vol.MapperPath {
+		t.Errorf("unexpected mount points %+v", mps)
+	}
+	limit, _ := ioutil.ReadFile(filepath.Join(podCgroup, "blkio.throttle.write_bps_device"))
+	if string(limit) != "253:0 10485760" {
+		t.Errorf("unexpected write bps limit of the pod %q", string(limit))
+	}
+	if _, err := os.Stat(filepath.Join(cgroup, "blkio", volumeCgroupFolder)); !os.IsNotExist(err) {
+		t.Errorf("no cgroup should be made for the volume, got %v", err)
+	}
+	if got, err := CgroupLimits(vol); err != nil || got[podUID+"/blkio.throttle.write_bps_device"] != "10485760" {
+		t.Errorf("expect the write bps limit of the pod, got %v, %v", got, err)
+	}
+
+	expanded, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId: volumeId, CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * GBSIZE}, VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume error %v", err)
+	}
+	if expanded.CapacityBytes != 2*GBSIZE || !expanded.NodeExpansionRequired || fake.lvs[0].size != 2*GBSIZE {
+		t.Errorf("lv should grow to %d bytes, got %v, lv %+v", 2*GBSIZE, expanded, fake.lvs[0])
+	}
+	grown, err := ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId: volumeId, VolumePath: targetPath, VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume error %v", err)
+	}
+	if grown.CapacityBytes != 2*GBSIZE || fake.calls[len(fake.calls)-1] != "resize2fs "+vol.MapperPath {
+		t.Errorf("filesystem should grow, got %v, last call %q", grown, fake.calls[len(fake.calls)-1])
+	}
+	if state, err := loadState(stateFile); err != nil || len(state.Volumes) != 1 || state.Volumes[0].VolSize != 2*GBSIZE {
+		t.Errorf("expanded size should be persisted, got %+v, %v", state, err)
+	}
+
+	if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeId, TargetPath: targetPath}); err != nil {
+		t.Fatalf("NodeUnpublishVolume error %v", err)
+	}
+	if _, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeId, StagingTargetPath: stagingPath}); err != nil {
+		t.Fatalf("NodeUnstageVolume error %v", err)
+	}
+	if mps, _ := mounter.List(); len(mps) != 0 {
+		t.Errorf("volume should be unmounted, got %+v", mps)
+	}
+
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId}); err != nil {
+		t.Fatalf("DeleteVolume error %v", err)
+	}
+	if len(fake.lvs) != 0 || len(registry.listVolumes()) != 0 {
+		t.Errorf("volume should be deleted, lv %+v, volumes %+v", fake.lvs, registry.listVolumes())
+	}
+	state, err := loadState(stateFile)
+	if err != nil || len(state.Volumes) != 0 {
+		t.Errorf("volume should be removed from the journal, got %+v, %v", state, err)
+	}
+}
+
+// a block volume is bind mounted from its device node to a file, which is removed after unpublish
+func TestBlockVolumeLifecycle(t *testing.T) {
+	cgroup, restoreCgroup := withCgroupRoot(t, false)
+	defer restoreCgroup()
+	dir, restore := withTestState(t)
+	defer restore()
+	vol := &lvmVolume{VolID: "id-1", VolName: "pvc-1", VolumeGroup: "vgdata", LvmName: "csi-id-1", VolSize: GBSIZE, Maj: "253", Min: "0",
+		Limits: ioLimits{WriteBps: 10 * MBSIZE}}
+	vol.MapperPath = lvMapperPath(vol.VolumeGroup, vol.LvmName)
+	registry.putVolume(vol)
+
+	// the layout kubelet publishes block volumes to
+	podUID := "8a5a7b2e-1111-2222-3333-444455556666"
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(kubeletBlockPublishDir, "pvc-1", podUID)
+	podCgroup := filepath.Join(cgroup, "blkio", "kubepods", "pod"+podUID)
+	if err := os.MkdirAll(podCgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mounter := &mount.FakeMounter{Filesystem: map[string]mount.FileType{targetPath: mount.FileTypeFile}}
+	fake := newFakeLVM(mounter, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "csi-id-1", vg: "vgdata", size: GBSIZE}}
+	// the fake mounter does not create the target file, it is made here
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(targetPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	ns := &nodeServer{DefaultNodeServer: csicommon.NewDefaultNodeServer(d), mounter: mounter, exec: fake}
+	ctx := context.Background()
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId: "id-2", StagingTargetPath: stagingPath, VolumeCapability: capability,
+	}); status.Code(err) != codes.NotFound {
+		t.Errorf("NodeStageVolume of unknown block volume should be NotFound, got %v", err)
+	}
+	if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId: "id-1", StagingTargetPath: stagingPath, VolumeCapability: capability,
+	}); err != nil {
+		t.Fatalf("NodeStageVolume error %v", err)
+	}
+	if mps, _ := mounter.List(); len(mps) != 0 {
+		t.Errorf("block volume should not be formatted or mounted at stage, got %+v", mps)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId: "id-1", StagingTargetPath: stagingPath, TargetPath: targetPath, VolumeCapability: capability, Readonly: true,
+		}); err != nil {
+			t.Fatalf("NodePublishVolume error %v", err)
+		}
+	}
+	mps, _ := mounter.List()
+	if len(mps) != 1 || mps[0].Device != vol.MapperPath || mps[0].Path != targetPath || mps[0].Opts[len(mps[0].Opts)-1] != "ro" {
+		t.Errorf("device should be bind mounted once read only, got %+v", mps)
+	}
+	limit, _ := ioutil.ReadFile(filepath.Join(podCgroup, "blkio.throttle.write_bps_device"))
+	if string(limit) != "253:0 10485760" {
+		t.Errorf("block volume should be throttled in the pod cgroup, got %q", limit)
+	}
+	if got, err := CgroupLimits(vol); err != nil || got[podUID+"/blkio.throttle.write_bps_device"] != "10485760" {
+		t.Errorf("expect limits of the published block volume, got %v, %v", got, err)
+	}
+
+	if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "id-1", TargetPath: targetPath}); err != nil {
+		t.Fatalf("NodeUnpublishVolume error %v", err)
+	}
+	if mps, _ := mounter.List(); len(mps) != 0 {
+		t.Errorf("device should be unmounted, got %+v", mps)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("target file should be removed, got %v", err)
+	}
+	limit, _ = ioutil.ReadFile(filepath.Join(podCgroup, "blkio.throttle.write_bps_device"))
+	if string(limit) != "253:0 0" {
+		t.Errorf("limits of the block volume should be cleared, got %q", limit)
+	}
+}
@@ -7,9 +7,11 @@ import (
 )
 
 const (
-	PluginFolder = "/var/lib/kubelet/pligins/lvmplugin.csi.alibabacloud.com"
+	PluginFolder = "/var/lib/kubelet/plugins/lvmplugin.csi.alibabacloud.com"
 	DriverName   = "lvmplugin.csi.alibabacloud.com"
 	CSIVersion   = "v1.0.0"
+	// the node holding the lv of the volume
+	TopologyKey = "topology.lvmplugin.csi.alibabacloud.com/node"
 )
 
 type lvm struct {
@@ -34,13 +36,19 @@ func NewDriver(nodeID, endpoint string, cache *ConfigCache) *lvm {
 	tmplvm.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 	})
 	tmplvm.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
 	// TODO
 	// create GRPC SERVER
-	tmplvm.idServer = csicommon.NewDefaultIdentityServer(tmplvm.driver)
-	tmplvm.controllerServer = NewControllerServer(tmplvm.driver, cache)
+	tmplvm.idServer = NewIdentityServer(tmplvm.driver)
+	tmplvm.controllerServer = NewControllerServer(tmplvm.driver, nodeID, cache)
 	tmpns, err := NewNodeServer(tmplvm.driver, false)
 	if err != nil {
 		glog.Errorf("lvm can't start node server,err %v \n", err)
@@ -52,6 +60,12 @@ func NewDriver(nodeID, endpoint string, cache *ConfigCache) *lvm {
 
 func (lvm *lvm) Run() {
 	glog.V(4).Infof("Starting csi-plugin Driver: %v version: %v", DriverName, CSIVersion)
+	stop := make(chan struct{})
+	defer close(stop)
+	go runCgroupSweeper(stop)
+	if cs, ok := lvm.controllerServer.(*controllerServer); ok && cs.k8sCache != nil && cs.k8sCache.Client != nil {
+		go cs.runLimitsSyncer(cs.k8sCache.Client.CoreV1().PersistentVolumeClaims(""), stop)
+	}
 	server := csicommon.NewNonBlockingGRPCServer()
 	server.Start(lvm.endpoint, lvm.idServer, lvm.controllerServer, lvm.nodeServer)
 	server.Wait()
@@ -1,191 +1,567 @@
 package lvm
 
 import (
-	"encoding/json"
 	"fmt"
 	"math"
-	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 const (
 	MBSIZE = 1024 * 1024
 	GBSIZE = 1024 * 1024 * 1024
+
+	// every lv created by the driver is tagged with csi-lvm.<field>=<value>
+	lvTagPrefix    = "csi-lvm."
+	lvTagVolID     = lvTagPrefix + "vol_id"
+	lvTagVolName   = lvTagPrefix + "vol_name"
+	lvTagBps       = lvTagPrefix + "bps"
+	lvTagReadBps   = lvTagPrefix + "read_bps"
+	lvTagWriteBps  = lvTagPrefix + "write_bps"
+	lvTagReadIops  = lvTagPrefix + "read_iops"
+	lvTagWriteIops = lvTagPrefix + "write_iops"
+	lvTagSize      = lvTagPrefix + "volume_size"
+	lvTagSnapID    = lvTagPrefix + "snap_id"
+	lvTagSnapName  = lvTagPrefix + "snap_name"
+	lvTagSource    = lvTagPrefix + "source_vol_id"
 )
 
+// characters lvm accepts in a tag
+var lvTagPattern = regexp.MustCompile(`^[A-Za-z0-9_+.\-/=!:&#]+$`)
+
 // using auto lvm name
 type lvmVolume struct {
-	VolName     string `json:"vol_name"`
-	LvmName     string `json:"lvm_name"`
-	VolID       string `json:"vol_id"`
-	DevicePath  string `json:"device_path"`
-	MapperPath  string `json:"mapper_path"`
-	VolumeGroup string `json:"volume_group"`
-	Maj         string `json:"maj"`
-	Min         string `json:"min"`
-	Bps         string `json:"bps"`
-	VolSize     int64  `json:"volume_size"`
+	VolName     string   `json:"vol_name"`
+	LvmName     string   `json:"lvm_name"`
+	VolID       string   `json:"vol_id"`
+	DevicePath  string   `json:"device_path"`
+	MapperPath  string   `json:"mapper_path"`
+	VolumeGroup string   `json:"volume_group"`
+	Maj         string   `json:"maj"`
+	Min         string   `json:"min"`
+	Bps         string   `json:"bps"`
+	VolSize     int64    `json:"volume_size"`
+	ThinPool    string   `json:"thin_pool,omitempty"`
+	Limits      ioLimits `json:"io_limits"`
+	// the limits of the storage class, the annotations of the pvc override them
+	ClassLimits *ioLimits `json:"class_limits,omitempty"`
+}
+
+type lvmSnapshot struct {
+	SnapName     string `json:"snap_name"`
+	SnapID       string `json:"snap_id"`
+	LvmName      string `json:"lvm_name"`
+	SourceVolID  string `json:"source_vol_id"`
+	VolumeGroup  string `json:"volume_group"`
+	SnapSize     int64  `json:"snap_size"`
+	SourceSize   int64  `json:"source_size"`
+	CreationTime int64  `json:"creation_time"`
+}
+
+type thinPoolInfo struct {
+	// size of the pool
+	Size int64
+	// sum of the virtual size of the thin volumes in the pool
+	VirtualSize int64
+	// size of the data written to the pool
+	UsedSize int64
 }
 
 type AllocationsLVM struct {
 	Allocation []lvmVolume `json:"allocation"`
 }
 
+// the vg of the node as reported by vgs, the sizes are in bytes
 type NodeLVMInfo struct {
 	Report []struct {
-		Vg []struct {
-			VgName    string `json:"vg_name"`
-			PvCount   string `json:"pv_count"`
-			LvCount   string `json:"lv_count"`
-			SnapCount string `json:"snap_count"`
-			VgAttr    string `json:"vg_attr"`
-			VgSize    string `json:"vg_size"`
-			VgFree    string `json:"vg_free"`
-		} `json:"vg"`
+		Vg []vgInfo `json:"vg"`
 	} `json:"report"`
+	// the thin pools in the vg, reported in the status of the LVMNode
+	thinPools []lvInfo
 }
 
 // TODO
 // Write to the /etc/fstab to avoid host restart
-func createLVMDevice(lvm *lvmVolume) error {
-	var sz int
-	var sz_unit string
-	// MB SIZE
-	if lvm.VolSize/GBSIZE <= 0 {
-		sz = int(math.Ceil(float64(lvm.VolSize * 1.0 / MBSIZE)))
-		sz_unit = "M"
-	} else {
-		sz = int(math.Ceil(float64(lvm.VolSize * 1.0 / GBSIZE)))
-		sz_unit = "G"
+func createLVMDevice(exec mount.Exec, lvm *lvmVolume) error {
+	if found, err := adoptVolumeLV(exec, lvm); found || err != nil {
+		return err
 	}
-	volSz := fmt.Sprintf("%d%s", sz, sz_unit)
-	// output, err := execCommand("lvcreate", []string{"-L", volSz, "-n", lvm.VolName, lvm.VolumeGroup})
-	output, err := execCommand("lvcreate", []string{"-L", volSz, lvm.VolumeGroup})
-	if err != nil {
-		glog.Errorf("%v failed to create lvm,output: %s", err, string(output))
+	volSz := lvSize(lvm.VolSize)
+	args := []string{"-L", volSz}
+	// thin volume only takes the virtual size, the blocks are allocated from the pool on write
+	if len(lvm.ThinPool) != 0 {
+		args = []string{"-V", volSz, "--thinpool", lvm.ThinPool}
+	}
+	name := lvNameFor(lvm.VolID)
+	args = append(args, "-n", name)
+	for _, tag := range lvTagsFor(lvm) {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, lvm.VolumeGroup)
+	if _, err := runLVM(exec, "lvcreate", args); err != nil {
+		glog.Errorf("failed to create lvm, %v", err)
 		return err
 	}
-	lvm.LvmName = extractLVMName(string(output))
-	if ok, maj, min := getDeviceNum(lvm); ok {
-		lvm.Maj = maj
-		lvm.Min = min
+	if err := lookupVolumeLV(exec, lvm); err != nil {
+		removeCreatedLV(exec, lvm, name)
+		return err
 	}
-	lvm.DevicePath = fmt.Sprintf("/dev/%s/%s", lvm.VolumeGroup, lvm.LvmName)
-	lvm.MapperPath = fmt.Sprintf("/dev/mapper/%s-%s", lvm.VolumeGroup, lvm.LvmName)
 	glog.V(4).Infof("success create lvm [%s] in vg [%s] with the path %s", lvm.LvmName, lvm.VolumeGroup, lvm.MapperPath)
 	return nil
 }
 
-//TODO
+// a CreateVolume retried after a crash finds the lv it created before under the name of the volume
+// the lv is taken over if it is tagged with the volume, another lv with the name is an error
+func adoptVolumeLV(exec mount.Exec, lvm *lvmVolume) (bool, error) {
+	if len(lvm.VolID) == 0 {
+		return false, fmt.Errorf("volume %s has no id", lvm.VolName)
+	}
+	name := lvNameFor(lvm.VolID)
+	lv, err := getLV(exec, lvm.VolumeGroup, name)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if vol := volumeFromLV(lv); vol == nil || vol.VolID != lvm.VolID {
+		return false, fmt.Errorf("lv %s/%s exists but does not belong to volume %s", lvm.VolumeGroup, name, lvm.VolID)
+	}
+	glog.V(4).Infof("lvm: take over lv %s/%s created before for volume %s", lvm.VolumeGroup, name, lvm.VolID)
+	return true, lookupVolumeLV(exec, lvm)
+}
+
+// find the lv just created for the volume by its vol_id tag,
+// and fill the name, the paths and the device number of the volume from it
+func lookupVolumeLV(exec mount.Exec, lvm *lvmVolume) error {
+	lv, err := findVolumeLV(exec, lvm.VolumeGroup, lvm.VolID)
+	if err != nil {
+		glog.Errorf("can't find the lv created for volume %s, %v", lvm.VolID, err)
+		return err
+	}
+	lvm.LvmName = lv.LvName
+	lvm.DevicePath = fmt.Sprintf("/dev/%s/%s", lvm.VolumeGroup, lvm.LvmName)
+	lvm.MapperPath = lvMapperPath(lvm.VolumeGroup, lvm.LvmName)
+	if maj, min, err := deviceNumber(lv); err == nil {
+		lvm.Maj, lvm.Min = maj, min
+	} else {
+		glog.Warningf("no device number of volume %s, %v", lvm.VolID, err)
+	}
+	return nil
+}
+
+// the device mapper node of the lv, the dashes in the names are doubled by device mapper
+func lvMapperPath(vg, name string) string {
+	return fmt.Sprintf("/dev/mapper/%s-%s", strings.Replace(vg, "-", "--", -1), strings.Replace(name, "-", "--", -1))
+}
+
+// TODO
 // update the /etc/fstab
-func deleteLVMDevice(lvm *lvmVolume) error {
+// remove the lv of the volume, a lv which is already gone is not an error
+func deleteLVMDevice(exec mount.Exec, lvm *lvmVolume) error {
 	glog.V(4).Infof("lvm: delete %s in %s ", lvm.VolName, lvm.VolumeGroup)
 	args := []string{"-y", lvm.MapperPath}
-	out, err := execCommand("lvremove", args)
-	// out, err := testConfig("lvremove", args)
-	if err != nil {
-		glog.Errorf("%v failed to remove lvm, output: %s", err, string(out))
+	if _, err := runLVM(exec, "lvremove", args); err != nil {
+		if _, lvErr := getLV(exec, lvm.VolumeGroup, lvm.LvmName); isNotFound(lvErr) {
+			glog.V(4).Infof("lvm [%s] in vg [%s] is already removed", lvm.LvmName, lvm.VolumeGroup)
+			return nil
+		}
+		glog.Errorf("failed to remove lvm, %v", err)
+		return err
 	}
 	glog.V(4).Infof("success remove lvm [%s] in vg [%s] with the path %s", lvm.LvmName, lvm.VolumeGroup, lvm.MapperPath)
 	return nil
 }
 
-func execCommand(command string, args []string) ([]byte, error) {
-	cmd := exec.Command(command, args...)
-	return cmd.CombinedOutput()
+// remove the lv just created by lvcreate when the volume can't be set up from it
+func removeCreatedLV(exec mount.Exec, lvm *lvmVolume, name string) {
+	lvm.LvmName = name
+	lvm.DevicePath = fmt.Sprintf("/dev/%s/%s", lvm.VolumeGroup, name)
+	lvm.MapperPath = lvMapperPath(lvm.VolumeGroup, name)
+	if err := deleteLVMDevice(exec, lvm); err != nil {
+		glog.Errorf("failed to roll back lv %s/%s, %v", lvm.VolumeGroup, name, err)
+	}
 }
 
-// Logical volume "lvol1" created.
-func extractLVMName(str string) string {
-	strs := strings.Split(str, `"`)
-	return strs[1]
+// create the lv with the content of the source lv
+// a thin source is cloned by a thin snapshot, others are copied block by block
+func cloneLVMDevice(exec mount.Exec, lvm *lvmVolume, srcVG, srcName string) error {
+	src, err := getLV(exec, srcVG, srcName)
+	if err != nil {
+		return err
+	}
+	if !isThinLV(src) {
+		if err := createLVMDevice(exec, lvm); err != nil {
+			return err
+		}
+		if err := copyLVMDevice(exec, fmt.Sprintf("/dev/%s/%s", srcVG, srcName), lvm.DevicePath); err != nil {
+			deleteLVMDevice(exec, lvm)
+			return err
+		}
+		return nil
+	}
+	if found, err := adoptVolumeLV(exec, lvm); found || err != nil {
+		return err
+	}
+	// -kn clears the activation skip flag which thin snapshots have by default
+	name := lvNameFor(lvm.VolID)
+	args := []string{"-s", "-kn", "-ay", "-n", name}
+	for _, tag := range lvTagsFor(lvm) {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", srcVG, srcName))
+	if _, err := runLVM(exec, "lvcreate", args); err != nil {
+		glog.Errorf("failed to create thin snapshot of %s/%s, %v", srcVG, srcName, err)
+		return err
+	}
+	if err := lookupVolumeLV(exec, lvm); err != nil {
+		removeCreatedLV(exec, lvm, name)
+		return err
+	}
+	if size, err := strconv.ParseInt(src.LvSize, 10, 64); err == nil && lvm.VolSize > size {
+		if err := extendLV(exec, lvm.VolumeGroup, lvm.LvmName, lvm.VolSize); err != nil {
+			deleteLVMDevice(exec, lvm)
+			return err
+		}
+	}
+	glog.V(4).Infof("success clone lvm [%s] from [%s] in vg [%s]", lvm.LvmName, srcName, lvm.VolumeGroup)
+	return nil
 }
 
-func getLVMVolumeByName(volName string) (*lvmVolume, error) {
-	for _, v := range lvmVolumes {
-		if v.VolName == volName {
-			return v, nil
-		}
+func copyLVMDevice(exec mount.Exec, src, dst string) error {
+	args := []string{fmt.Sprintf("if=%s", src), fmt.Sprintf("of=%s", dst), "bs=4M", "conv=fsync"}
+	out, err := execCommand(exec, "dd", args)
+	if err != nil {
+		glog.Errorf("%v failed to copy %s to %s, output: %s", err, src, dst, string(out))
+		return err
 	}
-	return nil, fmt.Errorf("can't find volName %s", volName)
+	return nil
 }
 
-// test cmd
-func testConfig(cmd string, args []string) ([]byte, error) {
-	for _, v := range args {
-		cmd += " " + v
+// grow the lv to the size
+func extendLV(exec mount.Exec, vg, name string, size int64) error {
+	args := []string{"-L", lvSize(size), fmt.Sprintf("%s/%s", vg, name)}
+	out, err := execCommand(exec, "lvextend", args)
+	if err != nil {
+		glog.Errorf("%v failed to extend %s/%s, output: %s", err, vg, name, string(out))
+		return err
 	}
-	fmt.Println(cmd)
-	return []byte(`Logical volume "lvol1" created.`), nil
+	return nil
 }
 
-// TODO
-// get all vg in the node
-// vg pv lv vgsize vgfree
+// replace the value of a csi-lvm tag
+func retagLV(exec mount.Exec, vg, name, key, oldValue, newValue string) error {
+	args := []string{
+		"--deltag", fmt.Sprintf("%s=%s", key, oldValue),
+		"--addtag", fmt.Sprintf("%s=%s", key, newValue),
+		fmt.Sprintf("%s/%s", vg, name),
+	}
+	out, err := execCommand(exec, "lvchange", args)
+	if err != nil {
+		return fmt.Errorf("lvchange error %v, output: %s", err, string(out))
+	}
+	return nil
+}
 
-func GetNodeInfo() (*NodeLVMInfo, error) {
-	node := &NodeLVMInfo{}
-	args := []string{"--columns", "--reportformat", "json"}
-	out, err := execCommand("vgdisplay", args)
+// grow the filesystem on the device to fill the device
+// ext* is grown by the device, xfs must be mounted and is grown by the mount point
+func resizeFilesystem(exec mount.Exec, devicePath, mountPath string) error {
+	out, err := execCommand(exec, "blkid", []string{"-o", "value", "-s", "TYPE", devicePath})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("blkid %s error %v, output: %s", devicePath, err, string(out))
+	}
+	fsType := strings.TrimSpace(string(out))
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		out, err = execCommand(exec, "resize2fs", []string{devicePath})
+	case "xfs":
+		if len(mountPath) == 0 {
+			return fmt.Errorf("xfs on %s must be mounted to grow", devicePath)
+		}
+		out, err = execCommand(exec, "xfs_growfs", []string{mountPath})
+	default:
+		return fmt.Errorf("unsupported filesystem %q on %s", fsType, devicePath)
 	}
-	err = json.Unmarshal(out, node)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("grow %s on %s error %v, output: %s", fsType, devicePath, err, string(out))
 	}
-	for i := range node.Report[0].Vg {
-		if node.Report[0].Vg[i].VgName == "centos" {
-			node.Report[0].Vg = append(node.Report[0].Vg[:i], node.Report[0].Vg[i+1:]...)
-			break
+	glog.V(4).Infof("success grow %s on %s", fsType, devicePath)
+	return nil
+}
+
+// create a snapshot lv of the source volume
+// the copy-on-write area is sized by the percent of the source size
+func createLVMSnapshot(exec mount.Exec, snap *lvmSnapshot, source *lvmVolume, percent int) error {
+	snap.SnapSize = int64(math.Ceil(float64(source.VolSize) * float64(percent) / 100))
+	snap.SourceSize = source.VolSize
+	snap.VolumeGroup = source.VolumeGroup
+	snap.LvmName = fmt.Sprintf("snap-%s", snap.SnapID)
+	args := []string{"-s", "-L", lvSize(snap.SnapSize), "-n", snap.LvmName}
+	for _, tag := range snapshotTagsFor(snap) {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", source.VolumeGroup, source.LvmName))
+	out, err := execCommand(exec, "lvcreate", args)
+	if err != nil {
+		glog.Errorf("%v failed to create snapshot, output: %s", err, string(out))
+		return err
+	}
+	glog.V(4).Infof("success create snapshot [%s] of [%s] in vg [%s]", snap.LvmName, source.LvmName, snap.VolumeGroup)
+	return nil
+}
+
+func deleteLVMSnapshot(exec mount.Exec, snap *lvmSnapshot) error {
+	args := []string{"-y", fmt.Sprintf("%s/%s", snap.VolumeGroup, snap.LvmName)}
+	out, err := execCommand(exec, "lvremove", args)
+	if err != nil {
+		glog.Errorf("%v failed to remove snapshot, output: %s", err, string(out))
+		return err
+	}
+	glog.V(4).Infof("success remove snapshot [%s] in vg [%s]", snap.LvmName, snap.VolumeGroup)
+	return nil
+}
+
+// size argument of lvcreate, round up to MB or GB
+func lvSize(size int64) string {
+	if size < GBSIZE {
+		return fmt.Sprintf("%dM", (size+MBSIZE-1)/MBSIZE)
+	}
+	return fmt.Sprintf("%dG", (size+GBSIZE-1)/GBSIZE)
+}
+
+// the commands of lvm and the other tools on the node run through the exec of the server,
+// which is also the Exec of the mounter so the format of the volumes goes through it too
+func execCommand(exec mount.Exec, command string, args []string) ([]byte, error) {
+	return exec.Run(command, args...)
+}
+
+// tags linking the lv back to the csi volume
+func lvTagsFor(lvm *lvmVolume) []string {
+	return buildLVTags(lvm.VolID, []string{
+		lvTagVolID, lvm.VolID,
+		lvTagVolName, lvm.VolName,
+		lvTagBps, lvm.Bps,
+		lvTagReadBps, strconv.FormatUint(lvm.Limits.ReadBps, 10),
+		lvTagWriteBps, strconv.FormatUint(lvm.Limits.WriteBps, 10),
+		lvTagReadIops, strconv.FormatUint(lvm.Limits.ReadIops, 10),
+		lvTagWriteIops, strconv.FormatUint(lvm.Limits.WriteIops, 10),
+		lvTagSize, strconv.FormatInt(lvm.VolSize, 10),
+	})
+}
+
+func snapshotTagsFor(snap *lvmSnapshot) []string {
+	return buildLVTags(snap.SnapID, []string{
+		lvTagSnapID, snap.SnapID,
+		lvTagSnapName, snap.SnapName,
+		lvTagSource, snap.SourceVolID,
+		lvTagSize, strconv.FormatInt(snap.SourceSize, 10),
+	})
+}
+
+// kvs is a list of key, value pairs
+func buildLVTags(id string, kvs []string) []string {
+	tags := []string{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		tag := fmt.Sprintf("%s=%s", kvs[i], kvs[i+1])
+		if len(kvs[i+1]) == 0 || !lvTagPattern.MatchString(tag) {
+			glog.Warningf("lvm: skip invalid tag %q of %s", tag, id)
+			continue
 		}
+		tags = append(tags, tag)
 	}
-	return node, nil
+	return tags
 }
 
-func getDeviceNum(lvm *lvmVolume) (bool, string, string) {
-	label := fmt.Sprintf("%s-%s", lvm.VolumeGroup, lvm.LvmName)
-	args := []string{`--output`, `NAME,MAJ:MIN`}
-	out, err := execCommand("lsblk", args)
-	lines := strings.Split(string(out), "\n")
-	var dn string
-	for _, line := range lines {
-		if ok := strings.Contains(line, label); ok {
-			cols := strings.Split(strings.Trim(line, " "), " ")
-			dn = cols[len(cols)-1]
+// csi-lvm.vol_id=xxx,csi-lvm.vol_name=yyy => {csi-lvm.vol_id: xxx, csi-lvm.vol_name: yyy}
+func parseLVTags(str string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], lvTagPrefix) {
+			continue
 		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags
+}
+
+// rebuild the lvmVolume from the tags of the lv
+// return nil if the lv is not created by the driver
+func volumeFromLV(lv *lvInfo) *lvmVolume {
+	tags := parseLVTags(lv.LvTags)
+	if len(tags[lvTagVolID]) == 0 {
+		return nil
+	}
+	vol := &lvmVolume{
+		VolID:       tags[lvTagVolID],
+		VolName:     tags[lvTagVolName],
+		Bps:         tags[lvTagBps],
+		LvmName:     lv.LvName,
+		VolumeGroup: lv.VgName,
+		Maj:         lv.LvKernelMaj,
+		Min:         lv.LvKernelMin,
+		ThinPool:    lv.PoolLv,
+	}
+	if len(vol.Bps) == 0 {
+		vol.Bps = "0"
+	}
+	limits := []struct {
+		key   string
+		value *uint64
+	}{
+		{lvTagReadBps, &vol.Limits.ReadBps},
+		{lvTagWriteBps, &vol.Limits.WriteBps},
+		{lvTagReadIops, &vol.Limits.ReadIops},
+		{lvTagWriteIops, &vol.Limits.WriteIops},
+	}
+	for _, l := range limits {
+		if v, err := strconv.ParseUint(tags[l.key], 10, 64); err == nil {
+			*l.value = v
+		}
+	}
+	if size, err := strconv.ParseInt(tags[lvTagSize], 10, 64); err == nil {
+		vol.VolSize = size
+	} else if size, err := strconv.ParseInt(lv.LvSize, 10, 64); err == nil {
+		vol.VolSize = size
+	}
+	vol.DevicePath = fmt.Sprintf("/dev/%s/%s", vol.VolumeGroup, vol.LvmName)
+	vol.MapperPath = lvMapperPath(vol.VolumeGroup, vol.LvmName)
+	return vol
+}
+
+// rebuild the lvmSnapshot from the tags of the lv
+// return nil if the lv is not a snapshot created by the driver
+func snapshotFromLV(lv *lvInfo) *lvmSnapshot {
+	tags := parseLVTags(lv.LvTags)
+	if len(tags[lvTagSnapID]) == 0 {
+		return nil
+	}
+	snap := &lvmSnapshot{
+		SnapID:      tags[lvTagSnapID],
+		SnapName:    tags[lvTagSnapName],
+		SourceVolID: tags[lvTagSource],
+		LvmName:     lv.LvName,
+		VolumeGroup: lv.VgName,
 	}
+	if size, err := strconv.ParseInt(tags[lvTagSize], 10, 64); err == nil {
+		snap.SourceSize = size
+	}
+	if size, err := strconv.ParseInt(lv.LvSize, 10, 64); err == nil {
+		snap.SnapSize = size
+	}
+	return snap
+}
+
+// the first character of lv_attr is V for thin volumes
+func isThinLV(lv *lvInfo) bool {
+	return strings.HasPrefix(lv.LvAttr, "V")
+}
+
+// the fifth character of lv_attr is a for active volumes
+func isActiveLV(lv *lvInfo) bool {
+	return len(lv.LvAttr) > 4 && lv.LvAttr[4] == 'a'
+}
+
+// the first character of lv_attr is t for thin pools
+func isThinPool(lv *lvInfo) bool {
+	return strings.HasPrefix(lv.LvAttr, "t")
+}
+
+// get the usage of the thin pool
+func getThinPoolInfo(exec mount.Exec, vg, pool string) (*thinPoolInfo, error) {
+	lvs, err := listVGLVs(exec, vg)
 	if err != nil {
-		return false, "", ""
+		return nil, err
 	}
-	if len(dn) == 0 {
-		return false, "", ""
+	var info *thinPoolInfo
+	var virtualSize int64
+	for i := range lvs {
+		lv := &lvs[i]
+		size, err := strconv.ParseInt(lv.LvSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q of lv %s/%s", lv.LvSize, vg, lv.LvName)
+		}
+		if lv.LvName == pool {
+			if !isThinPool(lv) {
+				return nil, fmt.Errorf("lv %s/%s is not a thin pool", vg, pool)
+			}
+			info = &thinPoolInfo{Size: size}
+			if percent, err := strconv.ParseFloat(lv.DataPercent, 64); err == nil {
+				info.UsedSize = int64(float64(size) * percent / 100)
+			}
+		} else if lv.PoolLv == pool && isThinLV(lv) {
+			virtualSize += size
+		}
 	}
-	strs := strings.Split(dn, ":")
-	return true, strs[0], strs[1]
+	if info == nil {
+		return nil, fmt.Errorf("can't find thin pool %s/%s", vg, pool)
+	}
+	info.VirtualSize = virtualSize
+	return info, nil
 }
 
-func setBps(lvm *lvmVolume) error {
-	cgpath := fmt.Sprintf("/sys/fs/cgroup/blkio/csi-lvm/%s/", lvm.VolName)
-	args1 := []string{"-p", cgpath}
-	_, err := execCommand("mkdir", args1)
+// parse the size reported by lvm, like 1073741824B, <99.51g or 10.00m
+// lower case units are based on 1024 and upper case ones are based on 1000
+func parseLVMSize(str string) (int64, error) {
+	str = strings.TrimPrefix(strings.TrimSpace(str), "<")
+	if len(str) == 0 {
+		return 0, fmt.Errorf("empty size")
+	}
+	units := "bskmgtpe"
+	unit := str[len(str)-1]
+	idx := strings.IndexByte(units, unit|0x20)
+	if idx < 0 {
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %q", str)
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(str[:len(str)-1], 64)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	switch idx {
+	case 0:
+		return int64(v), nil
+	case 1:
+		return int64(v * 512), nil
 	}
-	// set the bps
-	str := fmt.Sprintf(`"%s:%s %s"`, lvm.Maj, lvm.Min, lvm.Bps)
-	writePath := cgpath + "blkio.throttle.write_bps_device"
-	com := fmt.Sprintf(`echo "%s" > %s`, str, writePath)
-	cmd := exec.Command("bash", "-c", com)
-	fmt.Println("command is", com)
-	cmd.Start()
-	err = cmd.Wait()
+	base := 1024.0
+	if unit >= 'A' && unit <= 'Z' {
+		base = 1000.0
+	}
+	return int64(v * math.Pow(base, float64(idx-1))), nil
+}
+
+// find the volume of the name by the tags on the disk,
+// the lv outlives the journal if the driver stopped between lvcreate and persisting the state
+func findVolumeOnDisk(exec mount.Exec, volName string) (*lvmVolume, error) {
+	lvs, err := listLVs(exec)
 	if err != nil {
-		fmt.Printf("error:%v", err)
-		glog.V(4).Infof("SET BPS echo error , %v", err)
-		return err
+		return nil, err
 	}
-	return nil
+	volumeId := volumeIDFromName(volName)
+	for i := range lvs {
+		if snapshotFromLV(&lvs[i]) != nil {
+			continue
+		}
+		if vol := volumeFromLV(&lvs[i]); vol != nil && vol.VolID == volumeId {
+			return vol, nil
+		}
+	}
+	return nil, &notFoundError{Kind: "volume", Name: volName}
+}
+
+// test cmd
+func testConfig(cmd string, args []string) ([]byte, error) {
+	for _, v := range args {
+		cmd += " " + v
+	}
+	fmt.Println(cmd)
+	return []byte(`Logical volume "lvol1" created.`), nil
 }
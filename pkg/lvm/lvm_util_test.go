@@ -1,62 +1,231 @@
 package lvm
 
 import (
-	"fmt"
+	"flag"
+	"strings"
 	"testing"
-)
 
-func TestExtractLVMName(t *testing.T) {
-	tests := []struct {
-		v1  string
-		v2  string
-		res bool
-	}{
-		{
-			`Logical volume "lvol1" created.`,
-			"lvol1",
-			true,
-		},
-		{
-			`Logical volume "lvol1" created.`,
-			"lovl2",
-			false,
-		},
-	}
-	for _, v := range tests {
-		res := v.v2 == extractLVMName(v.v1)
-		// fmt.Println(v.v2, extractLVMName(v.v1), res)
-		if res != v.res {
-			t.Error(extractLVMName(v.v1), v.v2)
-		}
-	}
-}
+	"k8s.io/kubernetes/pkg/util/mount"
+)
 
 func TestCreateLVMDevice(t *testing.T) {
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	// lvm names the lv, which is found by the vol_id tag
+	fake.lvs = []*fakeLV{{name: "lvol9", vg: "vgdata", size: GBSIZE, minor: 9}}
+	fake.nextMin = 1
 	lvm := &lvmVolume{}
+	lvm.VolID = "id-1"
 	lvm.VolSize = 1024 * 1024 * 500
 	lvm.VolumeGroup = "vgdata"
-	createLVMDevice(lvm)
-	fmt.Printf("success create lvm [%s] in vg [%s] with the path %s", lvm.LvmName, lvm.VolumeGroup, lvm.MapperPath)
+	if err := createLVMDevice(fake, lvm); err != nil {
+		t.Fatalf("createLVMDevice error %v", err)
+	}
+	if lvm.LvmName != "csi-id-1" || lvm.MapperPath != "/dev/mapper/vgdata-csi--id--1" || lvm.Maj != "253" || lvm.Min != "1" {
+		t.Errorf("unexpected volume %+v", lvm)
+	}
+	if len(fake.lvs) != 2 || fake.lvs[1].size != lvm.VolSize {
+		t.Errorf("unexpected lv %+v", fake.lvs)
+	}
+	// a retry takes over the lv created before
+	retry := &lvmVolume{VolID: "id-1", VolSize: lvm.VolSize, VolumeGroup: "vgdata"}
+	if err := createLVMDevice(fake, retry); err != nil || retry.LvmName != lvm.LvmName || len(fake.lvs) != 2 {
+		t.Errorf("retry should find lv %s, got %+v, %v", lvm.LvmName, retry, err)
+	}
+	fake.lvs = append(fake.lvs, &fakeLV{name: "csi-id-3", vg: "vgdata", size: GBSIZE})
+	if err := createLVMDevice(fake, &lvmVolume{VolID: "id-3", VolSize: GBSIZE, VolumeGroup: "vgdata"}); err == nil {
+		t.Errorf("lv of another owner should not be taken over")
+	}
+	lvm = &lvmVolume{VolID: "id-2", VolSize: 20 * GBSIZE, VolumeGroup: "vgdata"}
+	if err := createLVMDevice(fake, lvm); err == nil {
+		t.Errorf("create lv larger than the vg should fail")
+	}
 }
 
 func TestDeleteLVMDevice(t *testing.T) {
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "lov1", vg: "vgdata", size: GBSIZE}}
 	lvm := &lvmVolume{}
 	lvm.LvmName = "lov1"
+	lvm.VolumeGroup = "vgdata"
 	lvm.MapperPath = "/dev/mapper/vgdata-lov1"
-	deleteLVMDevice(lvm)
+	if err := deleteLVMDevice(fake, lvm); err != nil {
+		t.Errorf("delete lv failed, %v", err)
+	}
+	if len(fake.lvs) != 0 {
+		t.Errorf("lv should be removed, got %+v", fake.lvs)
+	}
+	if err := deleteLVMDevice(fake, lvm); err != nil {
+		t.Errorf("delete removed lv should succeed, got %v", err)
+	}
+}
+
+func TestResizeFilesystem(t *testing.T) {
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	fake.fs["/dev/vgdata/ext"] = "ext4"
+	fake.fs["/dev/vgdata/xfs"] = "xfs"
+	fake.fs["/dev/vgdata/vfat"] = "vfat"
+	if err := resizeFilesystem(fake, "/dev/vgdata/ext", ""); err != nil || fake.calls[len(fake.calls)-1] != "resize2fs /dev/vgdata/ext" {
+		t.Errorf("ext4 should be grown by resize2fs, got %v, %v", fake.calls, err)
+	}
+	if err := resizeFilesystem(fake, "/dev/vgdata/xfs", "/mnt/xfs"); err != nil || fake.calls[len(fake.calls)-1] != "xfs_growfs /mnt/xfs" {
+		t.Errorf("xfs should be grown by xfs_growfs on its mount point, got %v, %v", fake.calls, err)
+	}
+	if err := resizeFilesystem(fake, "/dev/vgdata/xfs", ""); err == nil {
+		t.Errorf("unmounted xfs should not be grown")
+	}
+	if err := resizeFilesystem(fake, "/dev/vgdata/vfat", "/mnt/vfat"); err == nil {
+		t.Errorf("vfat should not be supported")
+	}
+	if err := resizeFilesystem(fake, "/dev/vgdata/none", "/mnt/none"); err == nil {
+		t.Errorf("device without filesystem should fail")
+	}
 }
 
 func TestGetNodeInfo(t *testing.T) {
-	node, _ := GetNodeInfo()
-	fmt.Printf("%v", node)
+	saved := allowedVGs
+	defer func() { allowedVGs = saved }()
+	mounter := &mount.FakeMounter{}
+	fake := newFakeLVM(mounter, &fakeVG{name: "vgdata", size: 10 * GBSIZE, tags: []string{"ssd"}}, &fakeVG{name: "system", size: 2 * GBSIZE})
+	fake.lvs = []*fakeLV{
+		{name: "lvol0", vg: "vgdata", size: 2 * GBSIZE},
+		{name: "pool0", vg: "vgdata", size: GBSIZE, thinPool: true},
+		{name: "root", vg: "system", size: GBSIZE},
+	}
+	mounter.Mount("/dev/mapper/system-root", "/", "xfs", nil)
+	flags := AddVGFilterFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	if err := flags.Apply(fake); err != nil {
+		t.Fatal(err)
+	}
+	node, err := GetNodeInfo(fake)
+	if err != nil {
+		t.Fatalf("GetNodeInfo error %v", err)
+	}
+	// the vg of / is excluded by default
+	if len(node.Report) != 1 || len(node.Report[0].Vg) != 1 {
+		t.Fatalf("unexpected node info %+v", node)
+	}
+	vg := node.Report[0].Vg[0]
+	if vg.VgName != "vgdata" || vg.VgFree != "7516192768" || vg.LvCount != "2" || vg.VgTags != "ssd" {
+		t.Errorf("unexpected vg %+v", vg)
+	}
+	if pools := thinPoolsStatus(node); len(pools) != 1 || pools[0].Name != "pool0" || pools[0].Size != GBSIZE {
+		t.Errorf("expect thin pool pool0, got %+v", pools)
+	}
+
+	// the exclude patterns replace the vg of the system
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags = AddVGFilterFlags(fs)
+	if err := fs.Parse([]string{"-exclude-vgs", "vg*"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Apply(fake); err != nil {
+		t.Fatal(err)
+	}
+	if !allowedVGs.allowed("system") || allowedVGs.allowed("vgdata") {
+		t.Errorf("expect only vg system allowed, got %+v", allowedVGs)
+	}
 }
 
-func TestGetDeviceNum(t *testing.T) {
-	lvm := &lvmVolume{}
-	lvm.VolumeGroup = "vgdata"
-	lvm.LvmName = "vol5"
-	ok, maj, min := getDeviceNum(lvm)
-	if ok {
-		fmt.Printf("maj:%s,min:%s", maj, min)
+func TestLVNameFor(t *testing.T) {
+	long := strings.Repeat("a", 80)
+	tests := []struct {
+		id   string
+		name string
+	}{
+		{"7f8d3d4e-1111-2222-3333-444455556666", "csi-7f8d3d4e-1111-2222-3333-444455556666"},
+	}
+	for _, v := range tests {
+		if name := lvNameFor(v.id); name != v.name {
+			t.Errorf("lvNameFor(%q) expect %q, got %q", v.id, v.name, name)
+		}
+	}
+	if name := lvNameFor("vol/1"); !strings.HasPrefix(name, "csi-vol_1-") || len(name) != len("csi-vol_1-")+16 {
+		t.Errorf("invalid characters should be replaced and hashed, got %q", name)
+	}
+	names := map[string]bool{}
+	for _, id := range []string{"vol/1", "vol_1", long, long + "b", long + "c"} {
+		name := lvNameFor(id)
+		if len(name) > maxLVNameLen || lvNameInvalid.MatchString(name) || names[name] {
+			t.Errorf("invalid or duplicated name %q of %q", name, id)
+		}
+		names[name] = true
+	}
+	if volumeIDFromName("pvc-1") != volumeIDFromName("pvc-1") || volumeIDFromName("pvc-1") == volumeIDFromName("pvc-2") {
+		t.Errorf("volume id should be derived from the name")
+	}
+	if err := SetLVPrefix("-bad"); err == nil {
+		t.Errorf("prefix starting with a dash should be rejected")
+	}
+}
+
+func TestGetLV(t *testing.T) {
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE}, &fakeVG{name: "vgdata2", size: 10 * GBSIZE})
+	fake.lvs = []*fakeLV{{name: "vol5", vg: "vgdata2", minor: 4}, {name: "vol5", vg: "vgdata", minor: 5}}
+	lv, err := getLV(fake, "vgdata", "vol5")
+	if err != nil {
+		t.Fatalf("getLV error %v", err)
+	}
+	maj, min, err := deviceNumber(lv)
+	if err != nil || maj != "253" || min != "5" {
+		t.Errorf("expect 253:5, got %s:%s, %v", maj, min, err)
+	}
+	if _, err := getLV(fake, "vgdata", "vol6"); !isNotFound(err) {
+		t.Errorf("expect not found error, got %v", err)
+	}
+	if _, _, err := deviceNumber(&lvInfo{LvKernelMaj: "-1", LvKernelMin: "-1"}); err == nil {
+		t.Errorf("inactive lv should have no device number")
+	}
+}
+
+func TestVolumeFromLV(t *testing.T) {
+	vol := &lvmVolume{
+		VolID:   "7f8d3d4e-1111-2222-3333-444455556666",
+		VolName: "pvc-1",
+		Bps:     "1048576",
+		VolSize: 1024 * 1024 * 500,
+	}
+	lv := &lvInfo{
+		LvName:      "lvol3",
+		VgName:      "vgdata",
+		LvSize:      "524288000",
+		LvTags:      strings.Join(append(lvTagsFor(vol), "other"), ","),
+		LvKernelMaj: "253",
+		LvKernelMin: "3",
+	}
+	got := volumeFromLV(lv)
+	if got == nil {
+		t.Fatal("tagged lv should be recognized")
+	}
+	if got.VolID != vol.VolID || got.VolName != vol.VolName || got.Bps != vol.Bps || got.VolSize != vol.VolSize {
+		t.Errorf("expect %v, got %v", vol, got)
+	}
+	if got.MapperPath != "/dev/mapper/vgdata-lvol3" || got.Maj != "253" || got.Min != "3" {
+		t.Errorf("unexpected device of %v", got)
+	}
+	if volumeFromLV(&lvInfo{LvName: "root", VgName: "centos"}) != nil {
+		t.Error("untagged lv should be ignored")
+	}
+}
+
+func TestParseLVMSize(t *testing.T) {
+	tests := []struct {
+		str  string
+		size int64
+		ok   bool
+	}{
+		{"1073741824B", 1073741824, true},
+		{"1073741824", 1073741824, true},
+		{"10.00m", 10 * MBSIZE, true},
+		{"<2.00g", 2 * GBSIZE, true},
+		{"1.50G", 1500000000, true},
+		{"8s", 4096, true},
+		{"", 0, false},
+		{"abc", 0, false},
+	}
+	for _, v := range tests {
+		size, err := parseLVMSize(v.str)
+		if (err == nil) != v.ok || size != v.size {
+			t.Errorf("parseLVMSize(%q) expect %d, got %d, %v", v.str, v.size, size, err)
+		}
 	}
 }
@@ -0,0 +1,233 @@
+package lvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// the lvm tools report in json with explicit fields and sizes in bytes,
+// so nothing depends on the locale, the column layout or the messages of lvm
+
+// lv reported by lvs --reportformat json
+type lvInfo struct {
+	LvName      string `json:"lv_name"`
+	VgName      string `json:"vg_name"`
+	LvSize      string `json:"lv_size"`
+	LvTags      string `json:"lv_tags"`
+	LvKernelMaj string `json:"lv_kernel_major"`
+	LvKernelMin string `json:"lv_kernel_minor"`
+	LvAttr      string `json:"lv_attr"`
+	PoolLv      string `json:"pool_lv"`
+	DataPercent string `json:"data_percent"`
+	LvPath      string `json:"lv_path"`
+	LvDmPath    string `json:"lv_dm_path"`
+}
+
+// vg reported by vgs --reportformat json
+type vgInfo struct {
+	VgName    string `json:"vg_name"`
+	PvCount   string `json:"pv_count"`
+	LvCount   string `json:"lv_count"`
+	SnapCount string `json:"snap_count"`
+	VgAttr    string `json:"vg_attr"`
+	VgSize    string `json:"vg_size"`
+	VgFree    string `json:"vg_free"`
+	VgTags    string `json:"vg_tags"`
+}
+
+// PVInfo is a pv reported by pvs --reportformat json
+type PVInfo struct {
+	PvName string `json:"pv_name"`
+	VgName string `json:"vg_name"`
+	PvSize string `json:"pv_size"`
+	PvFree string `json:"pv_free"`
+	PvAttr string `json:"pv_attr"`
+}
+
+// fields of lvInfo, vgInfo and PVInfo
+const (
+	lvsFields = "lv_name,vg_name,lv_size,lv_tags,lv_kernel_major,lv_kernel_minor,lv_attr,pool_lv,data_percent,lv_path,lv_dm_path"
+	vgsFields = "vg_name,pv_count,lv_count,snap_count,vg_attr,vg_size,vg_free,vg_tags"
+	pvsFields = "pv_name,vg_name,pv_size,pv_free,pv_attr"
+)
+
+type lvsReport struct {
+	Report []struct {
+		Lv []lvInfo `json:"lv"`
+	} `json:"report"`
+}
+
+type pvsReport struct {
+	Report []struct {
+		Pv []PVInfo `json:"pv"`
+	} `json:"report"`
+}
+
+// lvmError is a lvm command which failed
+type lvmError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *lvmError) Error() string {
+	return fmt.Sprintf("%s error %v, output: %s", e.Command, e.Err, strings.TrimSpace(e.Output))
+}
+
+// notFoundError is returned when the lv asked for does not exist
+type notFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("can't find %s %s", e.Kind, e.Name)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// run a lvm command, a failure is returned as lvmError
+func runLVM(exec mount.Exec, command string, args []string) ([]byte, error) {
+	out, err := execCommand(exec, command, args)
+	if err != nil {
+		return out, &lvmError{Command: command, Output: string(out), Err: err}
+	}
+	return out, nil
+}
+
+// run a report command of lvm and decode its json into report
+// the rows are filtered by the selection, like vg_name="vgdata", all rows if it is empty
+func runReport(exec mount.Exec, command, fields, selection string, report interface{}) error {
+	args := []string{"--reportformat", "json", "--units", "b", "--nosuffix", "-o", fields}
+	if len(selection) != 0 {
+		args = append(args, "-S", selection)
+	}
+	out, err := runLVM(exec, command, args)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, report); err != nil {
+		return &lvmError{Command: command, Output: string(out), Err: err}
+	}
+	return nil
+}
+
+func runLVs(exec mount.Exec, selection string) ([]lvInfo, error) {
+	report := &lvsReport{}
+	if err := runReport(exec, "lvs", lvsFields, selection, report); err != nil {
+		return nil, err
+	}
+	lvs := []lvInfo{}
+	for _, r := range report.Report {
+		lvs = append(lvs, r.Lv...)
+	}
+	return lvs, nil
+}
+
+// list all the lv in the node
+func listLVs(exec mount.Exec) ([]lvInfo, error) {
+	return runLVs(exec, "")
+}
+
+// list the lv in the vg
+func listVGLVs(exec mount.Exec, vg string) ([]lvInfo, error) {
+	return runLVs(exec, fmt.Sprintf("vg_name=%q", vg))
+}
+
+// get the lv by name
+func getLV(exec mount.Exec, vg, name string) (*lvInfo, error) {
+	lvs, err := runLVs(exec, fmt.Sprintf("vg_name=%q && lv_name=%q", vg, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(lvs) == 0 {
+		return nil, &notFoundError{Kind: "lv", Name: vg + "/" + name}
+	}
+	return &lvs[0], nil
+}
+
+// get the lv of the volume in the vg by its vol_id tag
+func findVolumeLV(exec mount.Exec, vg, volumeId string) (*lvInfo, error) {
+	lvs, err := listVGLVs(exec, vg)
+	if err != nil {
+		return nil, err
+	}
+	for i := range lvs {
+		if vol := volumeFromLV(&lvs[i]); vol != nil && vol.VolID == volumeId {
+			return &lvs[i], nil
+		}
+	}
+	return nil, &notFoundError{Kind: "lv of volume", Name: volumeId}
+}
+
+// the device number of the lv, which is only set while the lv is active
+func deviceNumber(lv *lvInfo) (string, string, error) {
+	if len(lv.LvKernelMaj) == 0 || strings.HasPrefix(lv.LvKernelMaj, "-") ||
+		len(lv.LvKernelMin) == 0 || strings.HasPrefix(lv.LvKernelMin, "-") {
+		return "", "", fmt.Errorf("lv %s/%s is not active", lv.VgName, lv.LvName)
+	}
+	return lv.LvKernelMaj, lv.LvKernelMin, nil
+}
+
+// GetNodeInfo lists the vg of the node allowed by the vg filter and the thin pools in them
+func GetNodeInfo(exec mount.Exec) (*NodeLVMInfo, error) {
+	node, err := listVGs(exec)
+	if err != nil {
+		return nil, err
+	}
+	lvs, err := listLVs(exec)
+	if err != nil {
+		glog.Errorf("can't list thin pools, %v", err)
+		return node, nil
+	}
+	for _, lv := range lvs {
+		if isThinPool(&lv) && allowedVGs.allowed(lv.VgName) {
+			node.thinPools = append(node.thinPools, lv)
+		}
+	}
+	return node, nil
+}
+
+// list the vg allowed by the vg filter
+func listVGs(exec mount.Exec) (*NodeLVMInfo, error) {
+	node := &NodeLVMInfo{}
+	if err := runReport(exec, "vgs", vgsFields, "", node); err != nil {
+		return nil, err
+	}
+	for r := range node.Report {
+		vgs := node.Report[r].Vg[:0]
+		for _, vg := range node.Report[r].Vg {
+			if allowedVGs.allowed(vg.VgName) {
+				vgs = append(vgs, vg)
+			}
+		}
+		node.Report[r].Vg = vgs
+	}
+	return node, nil
+}
+
+// ListPVs lists the pv of the vg allowed by the vg filter, sorted by name
+func ListPVs(exec mount.Exec) ([]PVInfo, error) {
+	report := &pvsReport{}
+	if err := runReport(exec, "pvs", pvsFields, "", report); err != nil {
+		return nil, err
+	}
+	pvs := []PVInfo{}
+	for _, r := range report.Report {
+		for _, pv := range r.Pv {
+			if len(pv.VgName) != 0 && allowedVGs.allowed(pv.VgName) {
+				pvs = append(pvs, pv)
+			}
+		}
+	}
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].PvName < pvs[j].PvName })
+	return pvs, nil
+}
@@ -0,0 +1,63 @@
+package lvm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+)
+
+// the lv of a volume is named <prefix><volume id>
+// so the name and the device path of a volume are known before it is created
+const defaultLVPrefix = "csi-"
+
+// lvm takes up to 127 characters, device mapper takes 127 for vg-lv with the dashes doubled,
+// so the name is kept short enough for any reasonable vg name
+const maxLVNameLen = 60
+
+// lvm allows these characters in the name, which must not start with a dash
+var (
+	lvPrefixPattern = regexp.MustCompile(`^([A-Za-z0-9+_.][A-Za-z0-9+_.\-]*)?$`)
+	lvNameInvalid   = regexp.MustCompile(`[^A-Za-z0-9+_.\-]`)
+)
+
+var lvPrefix = defaultLVPrefix
+
+// SetLVPrefix replaces the prefix of the lv names
+func SetLVPrefix(prefix string) error {
+	if !lvPrefixPattern.MatchString(prefix) || len(prefix) > maxLVNameLen/2 {
+		return fmt.Errorf("invalid lv prefix %q", prefix)
+	}
+	lvPrefix = prefix
+	glog.V(4).Infof("lv prefix: %q", prefix)
+	return nil
+}
+
+// the volume id is derived from the name of the request,
+// so a retried CreateVolume gets the same id and finds the lv it created before
+func volumeIDFromName(name string) string {
+	return uuid.NewSHA1(uuid.NameSpace_URL, []byte(DriverName+"/"+name)).String()
+}
+
+// the name of the lv of the volume
+// the characters lvm does not allow are replaced by _, and a name too long is cut
+// and ended with a hash of the id, so different ids never share a name
+func lvNameFor(volumeId string) string {
+	name := lvPrefix + lvNameInvalid.ReplaceAllString(volumeId, "_")
+	if strings.HasPrefix(name, "-") {
+		name = "_" + name
+	}
+	if len(name) <= maxLVNameLen && name == lvPrefix+volumeId {
+		return name
+	}
+	sum := sha256.Sum256([]byte(volumeId))
+	hash := hex.EncodeToString(sum[:])[:16]
+	if len(name) > maxLVNameLen-len(hash)-1 {
+		name = name[:maxLVNameLen-len(hash)-1]
+	}
+	return name + "-" + hash
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
-	"os/exec"
-
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
@@ -21,6 +23,8 @@ import (
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
 	mounter mount.Interface
+	// runs the lvm commands and formats the volumes, tests replace it with a fake
+	exec mount.Exec
 }
 
 func NewNodeServer(d *csicommon.CSIDriver, containerized bool) (*nodeServer, error) {
@@ -32,24 +36,121 @@ func NewNodeServer(d *csicommon.CSIDriver, containerized bool) (*nodeServer, err
 		}
 		mounter = mount.NewNsenterMounter("", ne)
 	}
+	// the device numbers of the volumes may change after the host reboot
+	reapplyVolumeLimits()
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
 		mounter:           mounter,
+		exec:              mount.NewOsExec(),
 	}, nil
 }
 
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	nscap := &csi.NodeServiceCapability{
-		Type: &csi.NodeServiceCapability_Rpc{
-			Rpc: &csi.NodeServiceCapability_RPC{
-				Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	caps := []*csi.NodeServiceCapability{}
+	for _, t := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	} {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: t,
+				},
 			},
-		},
+		})
 	}
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			nscap,
+		Capabilities: caps,
+	}, nil
+}
+
+// the volumes of the node are only accessible from the node
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.AccessibleTopology = &csi.Topology{
+		Segments: map[string]string{TopologyKey: resp.GetNodeId()},
+	}
+	return resp, nil
+}
+
+// bytes and inodes of a filesystem volume, or the device size of a block volume
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: Volume ID must be provided")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats: Volume Path must be provided")
+	}
+	vol, ok := registry.getVolume(req.GetVolumeId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: can't find volume %s", req.GetVolumeId())
+	}
+	// an abnormal lv is reported by the condition, the usage is still reported if it can be read
+	condition := volumeCondition(ns.exec, vol)
+	if condition.Abnormal {
+		glog.Errorf("NodeGetVolumeStats: volume %s is abnormal, %s", vol.VolID, condition.Message)
+	}
+	exist, err := ns.mounter.ExistsPath(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !exist {
+		return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: path %s does not exist", volumePath)
+	}
+	fileType, err := ns.mounter.GetFileType(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if fileType == mount.FileTypeBlockDev || fileType == mount.FileTypeFile {
+		out, err := execCommand(ns.exec, "blockdev", []string{"--getsize64", volumePath})
+		if err != nil {
+			glog.Errorf("NodeGetVolumeStats: can't get size of %s, %v, output: %s", volumePath, err, string(out))
+			if condition.Abnormal {
+				return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+			}
+			return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: can't get size of %s", volumePath)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: invalid size of %s", volumePath)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: size},
+			},
+			VolumeCondition: condition,
+		}, nil
+	}
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(volumePath, statfs); err != nil {
+		if condition.Abnormal {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: statfs %s error %v", volumePath, err)
+	}
+	bsize := int64(statfs.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * bsize,
+				Available: int64(statfs.Bavail) * bsize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Available: int64(statfs.Ffree),
+				Used:      int64(statfs.Files - statfs.Ffree),
+			},
 		},
+		VolumeCondition: condition,
 	}, nil
 }
 
@@ -57,9 +158,6 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	source := req.StagingTargetPath
 	targetPath := req.TargetPath
 	glog.V(4).Infof("NodePublishVolume: Starting mount, source %s > target %s", source, targetPath)
-	if !strings.HasSuffix(targetPath, "/mount") {
-		return nil, status.Errorf(codes.InvalidArgument, "malformed the value of target path: %s", targetPath)
-	}
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume: Volume ID must be provided")
 	}
@@ -69,6 +167,17 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume: Volume Capability must be provided")
 	}
+	done, err := startOperation("NodePublishVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if req.VolumeCapability.GetBlock() != nil {
+		return ns.publishBlockVolume(req)
+	}
+	if !strings.HasSuffix(targetPath, "/mount") {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed the value of target path: %s", targetPath)
+	}
 	// ensure the path exist
 	if err := ns.mounter.MakeDir(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -97,6 +206,45 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if err := ns.mounter.Mount(source, targetPath, fsType, options); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if vol, ok := registry.getVolume(req.VolumeId); ok {
+		applyIOLimits(vol, targetPath)
+	}
+	glog.V(4).Infof("NodePublishVolume: Mount Successful: target %v", targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// bind mount the device node of the lv to the target file
+func (ns *nodeServer) publishBlockVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	vol, ok := registry.getVolume(req.VolumeId)
+	if !ok {
+		glog.Errorf("NodePublishVolume: can't find %s in the lvmVols", req.GetVolumeId())
+		return nil, status.Error(codes.NotFound, "NodePublishVolume: can't find the requested lvmVol")
+	}
+	// the target path of a block volume is a file
+	if err := ns.mounter.MakeDir(filepath.Dir(targetPath)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.mounter.MakeFile(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		glog.V(4).Infof("NodePublishVolume: %s is already mounted", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	options := []string{"bind"}
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+	glog.V(4).Infof("NodePublishVolume: Starting bind mount device %s target %s", vol.MapperPath, targetPath)
+	if err := ns.mounter.Mount(vol.MapperPath, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	applyIOLimits(vol, targetPath)
 	glog.V(4).Infof("NodePublishVolume: Mount Successful: target %v", targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -104,6 +252,14 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 // this step is to umount the lv to the target path
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	targetPath := req.GetTargetPath()
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume: Volume ID must be provided")
+	}
+	done, err := startOperation("NodeUnpublishVolume", req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	// check if the folder is still exist
 	exist, err := ns.mounter.ExistsPath(targetPath)
 	if err != nil {
@@ -123,7 +279,7 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	// 	glog.Errorf("NodeUnpublishVolume: targetpath:%s not mount volume", targetPath)
 	// 	return nil, status.Error(codes.Internal, "NodeUnpublishVolume: target path is not a mount point")
 	// }
-	mnt, err := isMounted(targetPath)
+	mnt, err := isMounted(ns.exec, targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "NodeUnpublishVolume: can't find mount path")
 	}
@@ -131,6 +287,9 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		// glog.Errorf("NodeUnpublishVolume: targetpath:%s not mount volume", targetPath)
 		glog.V(4).Infof("NodeUnpublishVolume: targetpath:%s not mount volume", targetPath)
 		// return nil, status.Error(codes.Internal, "NodeUnpublishVolume: target path is not a mount point")
+		if err := ns.removeBlockTarget(targetPath); err != nil {
+			return nil, err
+		}
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
@@ -141,9 +300,33 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	}
 	glog.V(4).Infof("NodeUnpublishVolume: success unmount the target path %s", targetPath)
+	if vol, ok := registry.getVolume(req.GetVolumeId()); ok && !vol.ioLimits().empty() {
+		if err := clearPodLimits(vol, targetPath); err != nil {
+			glog.V(4).Infof("NodeUnpublishVolume: can't clear io limits of volume %s, %v", vol.VolID, err)
+		}
+	}
+	if err := ns.removeBlockTarget(targetPath); err != nil {
+		return nil, err
+	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// the file created by publishBlockVolume is removed after unmount
+func (ns *nodeServer) removeBlockTarget(targetPath string) error {
+	fileType, err := ns.mounter.GetFileType(targetPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if fileType != mount.FileTypeFile {
+		return nil
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("NodeUnpublishVolume: can't remove the target file %s", targetPath)
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	glog.V(4).Infof("NodeStageVolume: stage disk %s, taget path: %s", req.GetVolumeId(), req.StagingTargetPath)
 	// check the input args
@@ -154,6 +337,20 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
+	done, err := startOperation("NodeStageVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// block volume is bind mounted from the device node in NodePublishVolume
+	if req.VolumeCapability.GetBlock() != nil {
+		if _, ok := registry.getVolume(req.VolumeId); !ok {
+			glog.Errorf("NodeStageVolume: can't find %s in the lvmVols", req.GetVolumeId())
+			return nil, status.Error(codes.NotFound, "NodeStageVolume: can't find the requested lvmVol")
+		}
+		glog.V(4).Infof("NodeStageVolume: %s is a block volume, skip format", req.GetVolumeId())
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
 	// ensure the target path
 	// StagingTargetPath is like /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-20769dae-2616-11e9-b900-00163e0b8d64/globalmount
 	if err := ns.mounter.MakeDir(targetPath); err != nil {
@@ -169,7 +366,7 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.Internal, "NodeStageVolume: path has ready mounted")
 	}
 	// start to format and mount the logical volume
-	vol, ok := lvmVolumes[req.VolumeId]
+	vol, ok := registry.getVolume(req.VolumeId)
 	if !ok {
 		glog.Errorf("NodeStageVolume: can't find %s in the lvmVols", req.GetVolumeId())
 		return nil, status.Error(codes.Internal, "NodeStageVolume: can't find the requiested lvmVol")
@@ -181,10 +378,14 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		fsType = "ext4"
 	}
 	options := []string{}
-	deviceMouter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: mount.NewOsExec()}
+	deviceMouter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: ns.exec}
 	if err := deviceMouter.FormatAndMount(devicePath, targetPath, fsType, options); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	// the lv may be extended while it is not staged, grow the filesystem to fill it
+	if err := resizeFilesystem(ns.exec, devicePath, targetPath); err != nil {
+		glog.Errorf("NodeStageVolume: can't grow filesystem of %s, %v", req.GetVolumeId(), err)
+	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -198,6 +399,11 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume: no target path is provided")
 	}
+	done, err := startOperation("NodeUnstageVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	// check the folder exsists and umont it
 	exist, err := ns.mounter.ExistsPath(targetPath)
 	if err != nil {
@@ -208,7 +414,7 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if exist {
 		notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 		if notMnt {
 			// return nil, status.Error(codes.NotFound, "NodeUnstageVolume: Volume not mounted")
@@ -226,18 +432,86 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func isMounted(targetpath string) (bool, error) {
-	if len(targetpath) == 0 {
-		return false, errors.New("no target path is provided")
+// grow the filesystem of the volume after ControllerExpandVolume extended its lv
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: Volume ID must be provided")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume: Volume Path must be provided")
+	}
+	if req.GetVolumeCapability().GetBlock() == nil {
+		if err := ns.expandFilesystem(req.GetVolumeId(), req.GetVolumePath()); err != nil {
+			return nil, err
+		}
+	}
+	vol, ok := registry.getVolume(req.GetVolumeId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "NodeExpandVolume: can't find volume %s", req.GetVolumeId())
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: vol.VolSize}, nil
+}
+
+// grow the filesystem mounted at the path, an unmounted one is grown by NodeStageVolume
+func (ns *nodeServer) expandFilesystem(volumeId, volumePath string) error {
+	done, err := startOperation("expandFilesystem", volumeId)
+	if err != nil {
+		return err
+	}
+	defer done()
+	vol, ok := registry.getVolume(volumeId)
+	if !ok {
+		return status.Errorf(codes.NotFound, "expandFilesystem: can't find volume %s", volumeId)
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	// offline, it is grown in NodeStageVolume
+	if notMnt {
+		glog.V(4).Infof("expandFilesystem: %s is not mounted, grow it at the next stage", volumePath)
+		return nil
+	}
+	if err := resizeFilesystem(ns.exec, vol.MapperPath, volumePath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// the volume is abnormal if its lv is missing, not active or can't be checked
+func volumeCondition(exec mount.Exec, vol *lvmVolume) *csi.VolumeCondition {
+	lv, err := getLV(exec, vol.VolumeGroup, vol.LvmName)
+	if isNotFound(err) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("lv %s/%s is missing", vol.VolumeGroup, vol.LvmName)}
 	}
-	findmntCmd := "findmnt"
-	_, err := exec.LookPath(findmntCmd)
 	if err != nil {
-		return false, fmt.Errorf("%s is not in the PATH", findmntCmd)
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("can't check lv %s/%s, %v", vol.VolumeGroup, vol.LvmName, err)}
+	}
+	if !isActiveLV(lv) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("lv %s/%s is not active", vol.VolumeGroup, vol.LvmName)}
+	}
+	return &csi.VolumeCondition{Message: fmt.Sprintf("lv %s/%s is active", vol.VolumeGroup, vol.LvmName)}
+}
+
+// the limits live in the cgroup of the pod, which holds the processes doing the io
+// a volume without limits is not throttled, so it does not fail the publish
+func applyIOLimits(vol *lvmVolume, targetPath string) {
+	if err := setPodLimits(vol, targetPath); err != nil {
+		glog.Errorf("NodePublishVolume: can't set io limits of volume %s to the pod, %v", vol.VolID, err)
+	}
+}
+
+func isMounted(exec mount.Exec, targetpath string) (bool, error) {
+	if len(targetpath) == 0 {
+		return false, errors.New("no target path is provided")
 	}
 	args := []string{"-o", "TARGET,PROPAGATION,FSTYPE,OPTIONS", "-m", targetpath}
-	out, err := exec.Command(findmntCmd, args...).CombinedOutput()
+	out, err := execCommand(exec, "findmnt", args)
 	if err != nil {
+		// findmnt exits with 1 and prints nothing if the path is not mounted
+		if ee, ok := err.(k8sexec.ExitError); ok && ee.ExitStatus() == 1 && len(strings.TrimSpace(string(out))) == 0 {
+			return false, nil
+		}
 		return false, fmt.Errorf("checking mounted failed,err:%v and output %s", err, string(out))
 	}
 	strs := strings.Split(strings.TrimSpace(string(out)), "\n")
@@ -0,0 +1,83 @@
+package lvm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	dir, restore := withTestState(t)
+	defer restore()
+	vol := &lvmVolume{VolID: "id-1", VolName: "pvc-1", VolumeGroup: "vgdata", LvmName: "csi-id-1", VolSize: GBSIZE}
+	vol.MapperPath = lvMapperPath(vol.VolumeGroup, vol.LvmName)
+	registry.putVolume(vol)
+
+	mountPath := filepath.Join(dir, "mount")
+	devicePath := filepath.Join(dir, "device")
+	if err := os.MkdirAll(mountPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mounter := &mount.FakeMounter{Filesystem: map[string]mount.FileType{
+		mountPath:  mount.FileTypeDirectory,
+		devicePath: mount.FileTypeFile,
+	}}
+	if err := mounter.Mount(vol.MapperPath, devicePath, "", []string{"bind"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeLVM(mounter, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	lv := &fakeLV{name: "csi-id-1", vg: "vgdata", size: GBSIZE}
+	fake.lvs = []*fakeLV{lv}
+
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	ns := &nodeServer{DefaultNodeServer: csicommon.NewDefaultNodeServer(d), mounter: mounter, exec: fake}
+	ctx := context.Background()
+	stats := func(path string) *csi.NodeGetVolumeStatsResponse {
+		resp, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "id-1", VolumePath: path})
+		if err != nil {
+			t.Fatalf("NodeGetVolumeStats of %s error %v", path, err)
+		}
+		return resp
+	}
+
+	if _, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "id-2", VolumePath: mountPath}); status.Code(err) != codes.NotFound {
+		t.Errorf("NodeGetVolumeStats of unknown volume should be NotFound, got %v", err)
+	}
+	resp := stats(mountPath)
+	if len(resp.Usage) != 2 || resp.Usage[0].Unit != csi.VolumeUsage_BYTES || resp.Usage[0].Total == 0 ||
+		resp.Usage[1].Unit != csi.VolumeUsage_INODES {
+		t.Errorf("expect usage of bytes and inodes, got %+v", resp.Usage)
+	}
+	if resp.VolumeCondition.GetAbnormal() {
+		t.Errorf("active lv should be normal, got %+v", resp.VolumeCondition)
+	}
+	resp = stats(devicePath)
+	if len(resp.Usage) != 1 || resp.Usage[0].Total != GBSIZE {
+		t.Errorf("expect block volume of %d bytes, got %+v", GBSIZE, resp.Usage)
+	}
+
+	// an inactive lv is abnormal, the usage of the mounted filesystem is still reported
+	lv.inactive = true
+	resp = stats(mountPath)
+	if !resp.VolumeCondition.GetAbnormal() || len(resp.Usage) != 2 {
+		t.Errorf("inactive lv should be abnormal with usage, got %+v", resp)
+	}
+
+	// a missing lv is abnormal, the block device can't be read
+	fake.lvs = nil
+	resp = stats(mountPath)
+	if !resp.VolumeCondition.GetAbnormal() || len(resp.Usage) != 2 {
+		t.Errorf("missing lv should be abnormal with usage, got %+v", resp)
+	}
+	resp = stats(devicePath)
+	if !resp.VolumeCondition.GetAbnormal() || len(resp.Usage) != 0 {
+		t.Errorf("missing block lv should be abnormal without usage, got %+v", resp)
+	}
+}
@@ -0,0 +1,185 @@
+package lvm
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// the limits of a volume can be changed by the annotations of its pvc,
+// like lvmplugin.csi.alibabacloud.com/writeBps: 100Mi, 0 removes the limit
+const limitsAnnotationPrefix = DriverName + "/"
+
+// how long to wait before the pvc are listed and watched again,
+// or the pvc whose volume failed to update are synced again
+var limitsRetryInterval = 5 * time.Second
+
+// change the io limits of a live volume
+// the lv tags, the cgroups, the journal and the configmap are updated
+func (cs *controllerServer) updateVolumeLimits(volumeId string, limits ioLimits) error {
+	done, err := startOperation("updateVolumeLimits", volumeId)
+	if err != nil {
+		return err
+	}
+	defer done()
+	vol, ok := registry.getVolume(volumeId)
+	if !ok {
+		return fmt.Errorf("can't find volume %s", volumeId)
+	}
+	old := vol.ioLimits()
+	if old == limits {
+		return nil
+	}
+	vol.Limits = limits
+	// bps is the old write limit, keep it in line so it never comes back
+	oldBps := vol.Bps
+	vol.Bps = strconv.FormatUint(limits.WriteBps, 10)
+	if vol.VolSize != 0 {
+		tags := []struct {
+			key      string
+			old, new string
+		}{
+			{lvTagBps, oldBps, vol.Bps},
+			{lvTagReadBps, strconv.FormatUint(old.ReadBps, 10), strconv.FormatUint(limits.ReadBps, 10)},
+			{lvTagWriteBps, strconv.FormatUint(old.WriteBps, 10), strconv.FormatUint(limits.WriteBps, 10)},
+			{lvTagReadIops, strconv.FormatUint(old.ReadIops, 10), strconv.FormatUint(limits.ReadIops, 10)},
+			{lvTagWriteIops, strconv.FormatUint(old.WriteIops, 10), strconv.FormatUint(limits.WriteIops, 10)},
+		}
+		for _, t := range tags {
+			if t.old == t.new {
+				continue
+			}
+			if err := retagLV(cs.exec, vol.VolumeGroup, vol.LvmName, t.key, t.old, t.new); err != nil {
+				glog.Errorf("updateVolumeLimits: can't update tag %s of volume %s, %v", t.key, volumeId, err)
+			}
+		}
+	}
+	if err := rewriteVolumeLimits(vol); err != nil {
+		glog.Errorf("updateVolumeLimits: can't rewrite cgroup limits of volume %s, %v", volumeId, err)
+	}
+	registry.putVolume(vol)
+	if err := persistState(); err != nil {
+		return fmt.Errorf("can't persist volume %s, %v", volumeId, err)
+	}
+	cs.updateCache()
+	glog.V(4).Infof("updateVolumeLimits: volume %s limits %+v => %+v", volumeId, old, limits)
+	return nil
+}
+
+// the pvc of the cluster, listed and watched by the syncer
+type pvcSource interface {
+	List(opts metav1.ListOptions) (*v1.PersistentVolumeClaimList, error)
+	Watch(opts metav1.ListOptions) (watch.Interface, error)
+}
+
+// apply the limits in the annotations of the pvc if its volume is on the node
+// the limits of the storage class come back once the annotations are removed
+// return the error of the update, the pvc should be synced again then
+func (cs *controllerServer) syncPVCLimits(pvc *v1.PersistentVolumeClaim) error {
+	// the pv name is the name of the volume
+	if len(pvc.Spec.VolumeName) == 0 {
+		return nil
+	}
+	vol, ok := registry.volumeByName(pvc.Spec.VolumeName)
+	if !ok {
+		return nil
+	}
+	limits := vol.classLimits()
+	found, err := limits.merge(pvc.Annotations, limitsAnnotationPrefix)
+	if err != nil {
+		// retrying doesn't help until the annotations are changed
+		glog.Errorf("syncPVCLimits: pvc %s/%s has %v", pvc.Namespace, pvc.Name, err)
+		return nil
+	}
+	// without the limits of the class there is nothing to restore
+	if !found && vol.ClassLimits == nil {
+		return nil
+	}
+	if limits == vol.ioLimits() {
+		return nil
+	}
+	if err := cs.updateVolumeLimits(vol.VolID, limits); err != nil {
+		glog.Errorf("syncPVCLimits: can't update limits of pvc %s/%s, %v", pvc.Namespace, pvc.Name, err)
+		return err
+	}
+	return nil
+}
+
+// list the pvc and apply the changes of their annotations until the watch ends
+// return false if stop is closed
+func (cs *controllerServer) watchPVCLimits(pvcs pvcSource, stop <-chan struct{}) bool {
+	// the pvc whose volume failed to update, like while another operation on it is in flight,
+	// they are synced again on every retry until they succeed or change
+	failed := map[string]*v1.PersistentVolumeClaim{}
+	sync := func(pvc *v1.PersistentVolumeClaim) {
+		key := pvc.Namespace + "/" + pvc.Name
+		delete(failed, key)
+		if err := cs.syncPVCLimits(pvc); err != nil {
+			failed[key] = pvc
+		}
+	}
+	list, err := pvcs.List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("watchPVCLimits: can't list pvc, %v", err)
+		return true
+	}
+	for i := range list.Items {
+		sync(&list.Items[i])
+	}
+	w, err := pvcs.Watch(metav1.ListOptions{ResourceVersion: list.ResourceVersion})
+	if err != nil {
+		glog.Errorf("watchPVCLimits: can't watch pvc, %v", err)
+		return true
+	}
+	defer w.Stop()
+	retry := time.NewTicker(limitsRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return true
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if pvc, ok := event.Object.(*v1.PersistentVolumeClaim); ok {
+					sync(pvc)
+				}
+			case watch.Deleted:
+				if pvc, ok := event.Object.(*v1.PersistentVolumeClaim); ok {
+					delete(failed, pvc.Namespace+"/"+pvc.Name)
+				}
+			case watch.Error:
+				glog.Warningf("watchPVCLimits: watch of pvc failed, %v", event.Object)
+				return true
+			}
+		case <-retry.C:
+			pending := make([]*v1.PersistentVolumeClaim, 0, len(failed))
+			for _, pvc := range failed {
+				pending = append(pending, pvc)
+			}
+			for _, pvc := range pending {
+				sync(pvc)
+			}
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// watch the pvc and sync the limits of their volumes, until stop is closed
+// the pvc are listed again whenever the watch ends
+func (cs *controllerServer) runLimitsSyncer(pvcs pvcSource, stop <-chan struct{}) {
+	for cs.watchPVCLimits(pvcs, stop) {
+		select {
+		case <-time.After(limitsRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package lvm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// a volume of the class with a write limit of 1Mi
+func newLimitedVolume(id, name string, fake *fakeLVM) *lvmVolume {
+	class := ioLimits{WriteBps: MBSIZE}
+	vol := &lvmVolume{VolID: id, VolName: name, VolumeGroup: "vgdata", LvmName: "csi-" + id, VolSize: GBSIZE,
+		Bps: "1048576", Limits: class, ClassLimits: &class}
+	fake.lvs = append(fake.lvs, &fakeLV{name: vol.LvmName, vg: "vgdata", size: GBSIZE, tags: []string{
+		lvTagVolID + "=" + id, lvTagBps + "=1048576", lvTagReadBps + "=0", lvTagWriteBps + "=1048576",
+		lvTagReadIops + "=0", lvTagWriteIops + "=0",
+	}})
+	return vol
+}
+
+func withLimitsServer(t *testing.T) (*controllerServer, *fakeLVM, func()) {
+	_, restore := withTestState(t)
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1", exec: fake}
+	return cs, fake, restore
+}
+
+func TestUpdateVolumeLimits(t *testing.T) {
+	cs, fake, restore := withLimitsServer(t)
+	defer restore()
+	registry.putVolume(newLimitedVolume("id-1", "pvc-1", fake))
+
+	limits := ioLimits{WriteBps: 2 * MBSIZE, ReadIops: 100}
+	if err := cs.updateVolumeLimits("id-1", limits); err != nil {
+		t.Fatal(err)
+	}
+	vol, _ := registry.getVolume("id-1")
+	if vol.ioLimits() != limits || vol.Bps != "2097152" || *vol.ClassLimits != (ioLimits{WriteBps: MBSIZE}) {
+		t.Errorf("expect limits %+v of class 1Mi, got %+v", limits, vol)
+	}
+	tags := strings.Join(fake.lvs[0].tags, ",")
+	for _, tag := range []string{lvTagBps + "=2097152", lvTagWriteBps + "=2097152", lvTagReadIops + "=100", lvTagReadBps + "=0"} {
+		if !strings.Contains(tags, tag) {
+			t.Errorf("lv should be tagged %s, got %s", tag, tags)
+		}
+	}
+	if strings.Contains(tags, lvTagWriteBps+"=1048576") {
+		t.Errorf("old tag of the lv should be removed, got %s", tags)
+	}
+	state, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Volumes) != 1 || state.Volumes[0].Limits != limits {
+		t.Errorf("journal should have limits %+v, got %+v", limits, state.Volumes)
+	}
+
+	if err := cs.updateVolumeLimits("id-2", limits); err == nil {
+		t.Errorf("update of unknown volume should fail")
+	}
+	done, err := startOperation("test", "id-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if err := cs.updateVolumeLimits("id-1", ioLimits{}); status.Code(err) != codes.Aborted {
+		t.Errorf("update in flight should be Aborted, got %v", err)
+	}
+}
+
+// fakePVCs lists the pvc and sends their changes through the fake watcher
+type fakePVCs struct {
+	list    *v1.PersistentVolumeClaimList
+	watcher *watch.FakeWatcher
+}
+
+func (f *fakePVCs) List(opts metav1.ListOptions) (*v1.PersistentVolumeClaimList, error) {
+	return f.list.DeepCopy(), nil
+}
+
+func (f *fakePVCs) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.watcher, nil
+}
+
+func newPVC(name, volName string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volName},
+	}
+}
+
+func waitForLimits(t *testing.T, volumeId string, limits ioLimits) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		vol, _ := registry.getVolume(volumeId)
+		if vol.ioLimits() == limits {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect limits %+v of volume %s, got %+v", limits, volumeId, vol.ioLimits())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimitsSyncer(t *testing.T) {
+	cs, fake, restore := withLimitsServer(t)
+	defer restore()
+	registry.putVolume(newLimitedVolume("id-1", "pvc-1", fake))
+	// a volume created before the limits of the class were kept
+	old := newLimitedVolume("id-2", "pvc-2", fake)
+	old.ClassLimits = nil
+	registry.putVolume(old)
+
+	pvcs := &fakePVCs{
+		list: &v1.PersistentVolumeClaimList{Items: []v1.PersistentVolumeClaim{
+			*newPVC("claim-1", "pvc-1", map[string]string{limitsAnnotationPrefix + writeBpsKey: "10Mi"}),
+			*newPVC("claim-2", "pvc-2", nil),
+			*newPVC("claim-3", "pvc-3", map[string]string{limitsAnnotationPrefix + writeBpsKey: "20Mi"}),
+		}},
+		watcher: watch.NewFake(),
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		cs.runLimitsSyncer(pvcs, stop)
+		close(stopped)
+	}()
+
+	waitForLimits(t, "id-1", ioLimits{WriteBps: 10 * MBSIZE})
+	// the annotation is removed, the limits of the class come back
+	pvcs.watcher.Modify(newPVC("claim-1", "pvc-1", nil))
+	waitForLimits(t, "id-1", ioLimits{WriteBps: MBSIZE})
+	// the old volume keeps its limits and takes the annotations on top of them
+	pvcs.watcher.Modify(newPVC("claim-2", "pvc-2", map[string]string{limitsAnnotationPrefix + readIopsKey: "100"}))
+	waitForLimits(t, "id-2", ioLimits{WriteBps: MBSIZE, ReadIops: 100})
+	pvcs.watcher.Modify(newPVC("claim-2", "pvc-2", nil))
+	pvcs.watcher.Modify(newPVC("claim-1", "pvc-1", map[string]string{limitsAnnotationPrefix + readBpsKey: "bad"}))
+	pvcs.watcher.Add(newPVC("claim-1", "pvc-1", map[string]string{limitsAnnotationPrefix + readBpsKey: "1k"}))
+	waitForLimits(t, "id-1", ioLimits{WriteBps: MBSIZE, ReadBps: 1000})
+	waitForLimits(t, "id-2", ioLimits{WriteBps: MBSIZE, ReadIops: 100})
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("syncer should return once stopped")
+	}
+}
+
+func TestLimitsSyncerRetry(t *testing.T) {
+	cs, fake, restore := withLimitsServer(t)
+	defer restore()
+	saved := limitsRetryInterval
+	defer func() { limitsRetryInterval = saved }()
+	limitsRetryInterval = 10 * time.Millisecond
+	registry.putVolume(newLimitedVolume("id-1", "pvc-1", fake))
+	registry.putVolume(newLimitedVolume("id-2", "pvc-2", fake))
+
+	pvcs := &fakePVCs{list: &v1.PersistentVolumeClaimList{}, watcher: watch.NewFake()}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		cs.runLimitsSyncer(pvcs, stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// the change of the pvc comes while another operation on its volume is in flight
+	done, err := startOperation("test", "id-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvcs.watcher.Modify(newPVC("claim-1", "pvc-1", map[string]string{limitsAnnotationPrefix + writeBpsKey: "10Mi"}))
+	// the events are handled in order, claim-1 has been tried once claim-2 is synced
+	pvcs.watcher.Modify(newPVC("claim-2", "pvc-2", map[string]string{limitsAnnotationPrefix + writeBpsKey: "20Mi"}))
+	waitForLimits(t, "id-2", ioLimits{WriteBps: 20 * MBSIZE})
+	if vol, _ := registry.getVolume("id-1"); vol.ioLimits() != (ioLimits{WriteBps: MBSIZE}) {
+		t.Errorf("volume in flight shouldn't be updated, got %+v", vol.ioLimits())
+	}
+	done()
+	waitForLimits(t, "id-1", ioLimits{WriteBps: 10 * MBSIZE})
+}
@@ -0,0 +1,161 @@
+package lvm
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeRegistry holds the volumes and snapshots known to the driver
+// it is shared by the grpc handlers of the controller and the node server and by the syncers,
+// the volumes and snapshots are copied in and out so nobody writes to a shared one
+type volumeRegistry struct {
+	mu        sync.RWMutex
+	volumes   map[string]*lvmVolume
+	snapshots map[string]*lvmSnapshot
+	// the ids which have an operation in flight
+	inflight map[string]bool
+}
+
+func newVolumeRegistry() *volumeRegistry {
+	return &volumeRegistry{
+		volumes:   map[string]*lvmVolume{},
+		snapshots: map[string]*lvmSnapshot{},
+		inflight:  map[string]bool{},
+	}
+}
+
+var registry = newVolumeRegistry()
+
+func (r *volumeRegistry) getVolume(volumeId string) (*lvmVolume, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	vol, ok := r.volumes[volumeId]
+	if !ok {
+		return nil, false
+	}
+	copied := *vol
+	return &copied, true
+}
+
+func (r *volumeRegistry) volumeByName(volName string) (*lvmVolume, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, vol := range r.volumes {
+		if vol.VolName == volName {
+			copied := *vol
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// add the volume or replace the one with the same id
+func (r *volumeRegistry) putVolume(vol *lvmVolume) {
+	copied := *vol
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.volumes[vol.VolID] = &copied
+}
+
+func (r *volumeRegistry) deleteVolume(volumeId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.volumes, volumeId)
+}
+
+// all the volumes, ordered by volume id
+func (r *volumeRegistry) listVolumes() []*lvmVolume {
+	r.mu.RLock()
+	vols := make([]*lvmVolume, 0, len(r.volumes))
+	for _, vol := range r.volumes {
+		copied := *vol
+		vols = append(vols, &copied)
+	}
+	r.mu.RUnlock()
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].VolID < vols[j].VolID
+	})
+	return vols
+}
+
+func (r *volumeRegistry) getSnapshot(snapId string) (*lvmSnapshot, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snap, ok := r.snapshots[snapId]
+	if !ok {
+		return nil, false
+	}
+	copied := *snap
+	return &copied, true
+}
+
+func (r *volumeRegistry) putSnapshot(snap *lvmSnapshot) {
+	copied := *snap
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshots[snap.SnapID] = &copied
+}
+
+func (r *volumeRegistry) deleteSnapshot(snapId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.snapshots, snapId)
+}
+
+// all the snapshots, ordered by snapshot id
+func (r *volumeRegistry) listSnapshots() []*lvmSnapshot {
+	r.mu.RLock()
+	snaps := make([]*lvmSnapshot, 0, len(r.snapshots))
+	for _, snap := range r.snapshots {
+		copied := *snap
+		snaps = append(snaps, &copied)
+	}
+	r.mu.RUnlock()
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].SnapID < snaps[j].SnapID
+	})
+	return snaps
+}
+
+// mark the ids as having an operation in flight
+// return false and mark nothing if any of them already has one
+func (r *volumeRegistry) tryLock(ids ...string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		if r.inflight[id] {
+			return false
+		}
+	}
+	for _, id := range ids {
+		r.inflight[id] = true
+	}
+	return true
+}
+
+func (r *volumeRegistry) unlock(ids ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		delete(r.inflight, id)
+	}
+}
+
+// the lock of a snapshot name, apart from the volume and snapshot ids
+func snapshotNameKey(name string) string {
+	return "snapshot-name/" + name
+}
+
+// start an operation on the volumes or snapshots of the ids, the returned func ends it
+// the spec asks for ABORTED when an operation on the same volume is still in flight
+func startOperation(method string, ids ...string) (func(), error) {
+	if !registry.tryLock(ids...) {
+		glog.Warningf("%s: an operation on %v is already in flight", method, ids)
+		return nil, status.Errorf(codes.Aborted, "%s: an operation on %v is already in flight", method, ids)
+	}
+	return func() { registry.unlock(ids...) }, nil
+}
@@ -0,0 +1,92 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeRegistry(t *testing.T) {
+	r := newVolumeRegistry()
+	vol := &lvmVolume{VolID: "id-1", VolName: "pvc-1", VolSize: GBSIZE}
+	r.putVolume(vol)
+	// the registry keeps its own copy
+	vol.VolSize = 2 * GBSIZE
+	got, ok := r.getVolume("id-1")
+	if !ok || got.VolSize != GBSIZE {
+		t.Fatalf("expect volume of %d bytes, got %+v", GBSIZE, got)
+	}
+	got.VolSize = 3 * GBSIZE
+	if got, _ := r.volumeByName("pvc-1"); got == nil || got.VolSize != GBSIZE {
+		t.Errorf("volume should not change by its copy, got %+v", got)
+	}
+	r.deleteVolume("id-1")
+	if _, ok := r.getVolume("id-1"); ok {
+		t.Errorf("volume should be deleted")
+	}
+
+	if !r.tryLock("id-1", "id-2") {
+		t.Fatalf("lock of free ids should succeed")
+	}
+	if r.tryLock("id-2", "id-3") {
+		t.Errorf("lock of a locked id should fail")
+	}
+	if !r.tryLock("id-3") {
+		t.Errorf("failed lock should not keep any id")
+	}
+	r.unlock("id-1", "id-2")
+	if !r.tryLock("id-2") {
+		t.Errorf("lock of an unlocked id should succeed")
+	}
+}
+
+func TestVolumeRegistryConcurrent(t *testing.T) {
+	r := newVolumeRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("id-%d-%d", i, j)
+				r.putVolume(&lvmVolume{VolID: id})
+				r.listVolumes()
+				if _, ok := r.getVolume(id); !ok {
+					t.Errorf("can't find volume %s", id)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(r.listVolumes()); n != 800 {
+		t.Errorf("expect 800 volumes, got %d", n)
+	}
+}
+
+func TestOperationInFlight(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	d := csicommon.NewCSIDriver(DriverName, CSIVersion, "node1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	})
+	cs := &controllerServer{DefaultControllerServer: csicommon.NewDefaultControllerServer(d), nodeID: "node1"}
+
+	done, err := startOperation("test", "id-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "id-1"}); status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteVolume in flight should be Aborted, got %v", err)
+	}
+	done()
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "id-1"}); err != nil {
+		t.Errorf("DeleteVolume of unknown volume should succeed, got %v", err)
+	}
+}
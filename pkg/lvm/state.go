@@ -0,0 +1,224 @@
+package lvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// the journal of the volumes created by the driver
+// it lives in the plugin folder which is a hostPath, so it survives a restart of the plugin
+var stateFile = filepath.Join(PluginFolder, "volumes.json")
+
+// the journal is written by one goroutine at a time, with the registry as it is then
+var stateMu sync.Mutex
+
+// the lock of the journal held by the driver while it runs, so lvmctl never writes the journal under it
+// it is kept here since the lock goes with the file once it is garbage collected
+var stateLock *os.File
+
+// errStateLocked is returned when another process holds the lock of the journal
+var errStateLocked = errors.New("the journal is locked by another process")
+
+// take the lock of the journal, wait for it or fail with errStateLocked at once
+// the lock is released when the file is closed or the process exits
+func lockState(wait bool) (*os.File, error) {
+	path := stateFile + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create state folder error %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file %s error %v", path, err)
+	}
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, errStateLocked
+		}
+		return nil, fmt.Errorf("lock %s error %v", path, err)
+	}
+	return f, nil
+}
+
+type lvmState struct {
+	Volumes   []lvmVolume   `json:"volumes"`
+	Snapshots []lvmSnapshot `json:"snapshots,omitempty"`
+}
+
+// read the journal from the disk
+// a journal which does not exist is treated as empty
+func loadState(path string) (*lvmState, error) {
+	state := &lvmState{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("read state file %s error %v", path, err)
+	}
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parse state file %s error %v", path, err)
+	}
+	return state, nil
+}
+
+// write the journal to a temp file and rename it
+// so a crash in the middle never leaves a truncated journal behind
+func saveState(path string, state *lvmState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create state folder error %v", err)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("open state file %s error %v", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write state file %s error %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync state file %s error %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reload the registry from the journal
+func restoreState() error {
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	for i := range state.Volumes {
+		// journals written before the placeholders were left out may still have them
+		if state.Volumes[i].VolSize == 0 {
+			continue
+		}
+		registry.putVolume(&state.Volumes[i])
+	}
+	for i := range state.Snapshots {
+		registry.putSnapshot(&state.Snapshots[i])
+	}
+	glog.V(4).Infof("restore %d volumes and %d snapshots from %s", len(state.Volumes), len(state.Snapshots), stateFile)
+	return nil
+}
+
+// write the volumes and snapshots of the registry to the journal
+// the placeholders registered by ControllerPublishVolume have no size and are not written,
+// they only live until ControllerUnpublishVolume
+func persistState() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state := &lvmState{}
+	for _, v := range registry.listVolumes() {
+		if v.VolSize == 0 {
+			continue
+		}
+		state.Volumes = append(state.Volumes, *v)
+	}
+	for _, s := range registry.listSnapshots() {
+		state.Snapshots = append(state.Snapshots, *s)
+	}
+	return saveState(stateFile, state)
+}
+
+type reconcileReport struct {
+	// tagged by the driver but not in the journal, they are added back
+	Unknown []string
+	// in the journal but not found on the disk
+	Missing []string
+}
+
+// compare the journal with the lv tags on the disk
+// the tags are the source of truth for the lv name and the device number,
+// which can change after the host reboot
+func reconcileVolumes(exec mount.Exec) (*reconcileReport, error) {
+	lvs, err := listLVs(exec)
+	if err != nil {
+		return nil, err
+	}
+	report := &reconcileReport{}
+	found := map[string]bool{}
+	for i := range lvs {
+		if snap := snapshotFromLV(&lvs[i]); snap != nil {
+			if _, ok := registry.getSnapshot(snap.SnapID); !ok {
+				report.Unknown = append(report.Unknown, snap.SnapID)
+				snap.CreationTime = time.Now().UnixNano()
+				registry.putSnapshot(snap)
+			}
+			continue
+		}
+		vol := volumeFromLV(&lvs[i])
+		if vol == nil {
+			continue
+		}
+		found[vol.VolID] = true
+		known, ok := registry.getVolume(vol.VolID)
+		if !ok {
+			report.Unknown = append(report.Unknown, vol.VolID)
+			registry.putVolume(vol)
+			continue
+		}
+		known.LvmName = vol.LvmName
+		known.VolumeGroup = vol.VolumeGroup
+		known.DevicePath = vol.DevicePath
+		known.MapperPath = vol.MapperPath
+		known.Maj = vol.Maj
+		known.Min = vol.Min
+		registry.putVolume(known)
+	}
+	for _, vol := range registry.listVolumes() {
+		// volumes registered by ControllerPublishVolume have no size and no tags
+		if vol.VolSize == 0 {
+			continue
+		}
+		if !found[vol.VolID] {
+			report.Missing = append(report.Missing, vol.VolID)
+		}
+	}
+	return report, nil
+}
+
+// LoadAllocations reads the volumes of the node from the journal of the driver
+// so other processes on the node see the same state as the driver
+func LoadAllocations() (AllocationsLVM, error) {
+	state, err := loadState(stateFile)
+	if err != nil {
+		return AllocationsLVM{}, err
+	}
+	allocation := AllocationsLVM{Allocation: []lvmVolume{}}
+	for _, vol := range state.Volumes {
+		vol.Limits = vol.ioLimits()
+		allocation.Allocation = append(allocation.Allocation, vol)
+	}
+	sort.Slice(allocation.Allocation, func(i, j int) bool {
+		return allocation.Allocation[i].VolID < allocation.Allocation[j].VolID
+	})
+	return allocation, nil
+}
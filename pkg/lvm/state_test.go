@@ -0,0 +1,121 @@
+package lvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// point the journal and the target paths of kubelet at a temp dir and start with an empty registry,
+// the returned func puts them back and removes the dir
+func withTestState(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "csi-lvm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedState, savedRegistry, savedPods, savedBlock := stateFile, registry, kubeletPodsDir, kubeletBlockPublishDir
+	stateFile = filepath.Join(dir, "volumes.json")
+	registry = newVolumeRegistry()
+	kubeletPodsDir = filepath.Join(dir, "pods")
+	kubeletBlockPublishDir = filepath.Join(dir, "plugins", "kubernetes.io", "csi", "volumeDevices", "publish")
+	return dir, func() {
+		stateFile, registry, kubeletPodsDir, kubeletBlockPublishDir = savedState, savedRegistry, savedPods, savedBlock
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-lvm-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "volumes.json")
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("load missing state error %v", err)
+	}
+	if len(state.Volumes) != 0 {
+		t.Errorf("missing state should be empty, got %v", state.Volumes)
+	}
+
+	state.Volumes = append(state.Volumes, lvmVolume{
+		VolName:     "pvc-1",
+		LvmName:     "lvol0",
+		VolID:       "id-1",
+		VolumeGroup: "vgdata",
+		Bps:         "0",
+		VolSize:     GBSIZE,
+	})
+	if err := saveState(path, state); err != nil {
+		t.Fatalf("save state error %v", err)
+	}
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("load state error %v", err)
+	}
+	if len(loaded.Volumes) != 1 || loaded.Volumes[0] != state.Volumes[0] {
+		t.Errorf("expect %v, got %v", state.Volumes, loaded.Volumes)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp state file should be renamed")
+	}
+}
+
+// the placeholders of ControllerPublishVolume are neither written nor restored
+func TestPersistStateSkipsPlaceholders(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	registry.putVolume(&lvmVolume{VolID: "id-1", VolName: "pvc-1", VolSize: GBSIZE})
+	registry.putVolume(&lvmVolume{VolID: "id-2", VolumeGroup: "vgdata", Maj: "253", Min: "1"})
+	if err := persistState(); err != nil {
+		t.Fatalf("persist state error %v", err)
+	}
+	state, err := loadState(stateFile)
+	if err != nil || len(state.Volumes) != 1 || state.Volumes[0].VolID != "id-1" {
+		t.Errorf("only id-1 should be persisted, got %+v, %v", state, err)
+	}
+
+	// a journal written before still has the placeholder
+	state.Volumes = append(state.Volumes, lvmVolume{VolID: "id-2", VolumeGroup: "vgdata"})
+	if err := saveState(stateFile, state); err != nil {
+		t.Fatal(err)
+	}
+	registry = newVolumeRegistry()
+	if err := restoreState(); err != nil {
+		t.Fatalf("restore state error %v", err)
+	}
+	if vols := registry.listVolumes(); len(vols) != 1 || vols[0].VolID != "id-1" {
+		t.Errorf("only id-1 should be restored, got %+v", vols)
+	}
+}
+
+func TestForceDeleteVolumeLocked(t *testing.T) {
+	_, restore := withTestState(t)
+	defer restore()
+	if err := saveState(stateFile, &lvmState{Volumes: []lvmVolume{{VolID: "id-1", VolumeGroup: "vgdata", VolSize: GBSIZE}}}); err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeLVM(nil, &fakeVG{name: "vgdata", size: 10 * GBSIZE})
+
+	// the running driver holds the journal
+	lock, err := lockState(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ForceDeleteVolume(fake, "id-1"); err == nil {
+		t.Errorf("force delete should fail while the driver is running")
+	}
+	if state, _ := loadState(stateFile); len(state.Volumes) != 1 {
+		t.Errorf("journal should not change, got %+v", state.Volumes)
+	}
+	lock.Close()
+	if err := ForceDeleteVolume(fake, "id-1"); err != nil {
+		t.Fatalf("force delete error %v", err)
+	}
+	if state, _ := loadState(stateFile); len(state.Volumes) != 0 {
+		t.Errorf("volume should be removed from the journal, got %+v", state.Volumes)
+	}
+}
@@ -0,0 +1,57 @@
+package lvm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// the overprovisioning ratio of the thin pools, keyed by vg/pool
+// the virtual size of a pool can not exceed its size * ratio, a pool without a ratio is not limited
+var thinPoolRatios = map[string]float64{}
+
+// SetOverProvisionRatios sets the ratio of the thin pools from items like vgdata/pool0=2.5
+func SetOverProvisionRatios(items []string) error {
+	ratios := map[string]float64{}
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(strings.Split(kv[0], "/")) != 2 {
+			return fmt.Errorf("invalid overprovisioning ratio %q, expect vg/pool=ratio", item)
+		}
+		r, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || r <= 0 {
+			return fmt.Errorf("invalid overprovisioning ratio %q", item)
+		}
+		ratios[kv[0]] = r
+	}
+	thinPoolRatios = ratios
+	glog.V(4).Infof("thin pool overprovisioning ratios: %v", ratios)
+	return nil
+}
+
+func overProvisionRatio(vg, pool string) (float64, bool) {
+	r, ok := thinPoolRatios[vg+"/"+pool]
+	return r, ok
+}
+
+var (
+	thinPoolLocksMu sync.Mutex
+	thinPoolLocks   = map[string]*sync.Mutex{}
+)
+
+// hold the thin pool from the ratio check until the lv is created in it,
+// so two volumes can't both pass the check on the same free room
+func lockThinPool(vg, pool string) func() {
+	thinPoolLocksMu.Lock()
+	l, ok := thinPoolLocks[vg+"/"+pool]
+	if !ok {
+		l = &sync.Mutex{}
+		thinPoolLocks[vg+"/"+pool] = l
+	}
+	thinPoolLocksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
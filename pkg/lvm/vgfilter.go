@@ -0,0 +1,48 @@
+package lvm
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// vgFilter decides which vg the driver may report and allocate from
+// both lists hold glob patterns, an empty include list allows every vg
+type vgFilter struct {
+	include []string
+	exclude []string
+}
+
+// every vg is allowed until the filter is set from the flags at start
+var allowedVGs = &vgFilter{}
+
+// SetVGFilter replaces the include and exclude patterns of the vg
+func SetVGFilter(include, exclude []string) error {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid vg pattern %q", pattern)
+		}
+	}
+	allowedVGs = &vgFilter{include: include, exclude: exclude}
+	glog.V(4).Infof("vg filter: include %v, exclude %v", include, exclude)
+	return nil
+}
+
+// exclude wins over include
+func (f *vgFilter) allowed(vg string) bool {
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, vg); ok {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if ok, _ := path.Match(pattern, vg); ok {
+			return true
+		}
+	}
+	return false
+}
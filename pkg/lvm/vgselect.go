@@ -0,0 +1,177 @@
+package lvm
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	// comma separated vg tags, a vg is selected only if it has all of them
+	vgSelectorKey = "vgSelector"
+	// the policy to choose the vg from the selected ones
+	vgPolicyKey     = "vgPolicy"
+	defaultVGPolicy = "mostFree"
+)
+
+type vgCandidate struct {
+	Name string
+	Free int64
+}
+
+// vgPolicy chooses one of the candidates, all of them have enough free space for the volume
+type vgPolicy interface {
+	Choose(candidates []vgCandidate) vgCandidate
+}
+
+var vgPolicies = map[string]vgPolicy{
+	"mostFree":   mostFreePolicy{},
+	"leastFree":  leastFreePolicy{},
+	"roundRobin": &roundRobinPolicy{},
+}
+
+// spread the volumes to the vg with the most free space
+type mostFreePolicy struct{}
+
+func (mostFreePolicy) Choose(candidates []vgCandidate) vgCandidate {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Free > best.Free {
+			best = c
+		}
+	}
+	return best
+}
+
+// binpack the volumes to the vg with the least free space
+type leastFreePolicy struct{}
+
+func (leastFreePolicy) Choose(candidates []vgCandidate) vgCandidate {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Free < best.Free {
+			best = c
+		}
+	}
+	return best
+}
+
+// take the candidates in turn
+type roundRobinPolicy struct {
+	next uint64
+}
+
+func (p *roundRobinPolicy) Choose(candidates []vgCandidate) vgCandidate {
+	n := atomic.AddUint64(&p.next, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// list the vg allowed by the vg and vgSelector parameters, sorted by name
+// all the vg in the node are allowed if both are omitted
+func listVGCandidates(exec mount.Exec, params map[string]string) ([]vgCandidate, error) {
+	node, err := listVGs(exec)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, name := range SplitList(params["vg"]) {
+		names[name] = true
+	}
+	selector := SplitList(params[vgSelectorKey])
+	candidates := []vgCandidate{}
+	for _, report := range node.Report {
+		for _, vg := range report.Vg {
+			if len(names) != 0 && !names[vg.VgName] {
+				continue
+			}
+			if !hasAllTags(vg.VgTags, selector) {
+				continue
+			}
+			free, err := parseLVMSize(vg.VgFree)
+			if err != nil {
+				glog.Errorf("invalid free size of vg %s, %v", vg.VgName, err)
+				continue
+			}
+			candidates = append(candidates, vgCandidate{Name: vg.VgName, Free: free})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates, nil
+}
+
+func hasAllTags(tags string, selector []string) bool {
+	has := map[string]bool{}
+	for _, tag := range SplitList(tags) {
+		has[tag] = true
+	}
+	for _, tag := range selector {
+		if !has[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// choose the vg of the volume
+// a volume with content source must be in the vg of the source
+// a thin volume must be in the only vg given with the thin pool
+func chooseVolumeGroup(exec mount.Exec, params map[string]string, size int64, srcVG string) (string, error) {
+	candidates, err := listVGCandidates(exec, params)
+	if err != nil {
+		glog.Errorf("CreateVolume: can't list vg, %v", err)
+		return "", status.Error(codes.Internal, "CreateVolume: can't list vg")
+	}
+	if len(candidates) == 0 {
+		return "", status.Error(codes.InvalidArgument, "CreateVolume: no vg matches the parameters")
+	}
+	if len(srcVG) != 0 {
+		for _, c := range candidates {
+			if c.Name == srcVG {
+				return srcVG, nil
+			}
+		}
+		return "", status.Errorf(codes.InvalidArgument, "CreateVolume: source is in vg %s, not in the requested vg", srcVG)
+	}
+	if len(params[thinPoolKey]) != 0 {
+		if len(candidates) != 1 {
+			return "", status.Errorf(codes.InvalidArgument, "CreateVolume: %s requires exactly one vg", thinPoolKey)
+		}
+		return candidates[0].Name, nil
+	}
+	name := params[vgPolicyKey]
+	if len(name) == 0 {
+		name = defaultVGPolicy
+	}
+	policy, ok := vgPolicies[name]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument, "CreateVolume: unknown %s %q", vgPolicyKey, name)
+	}
+	fits := []vgCandidate{}
+	for _, c := range candidates {
+		if c.Free >= size {
+			fits = append(fits, c)
+		}
+	}
+	if len(fits) == 0 {
+		return "", status.Errorf(codes.ResourceExhausted, "CreateVolume: no vg has %d bytes free", size)
+	}
+	chosen := policy.Choose(fits)
+	glog.V(4).Infof("CreateVolume: choose vg %s with %d bytes free by policy %s", chosen.Name, chosen.Free, name)
+	return chosen.Name, nil
+}
+
+// the parameters of the volume with the chosen vg
+func volumeContext(params map[string]string, vg string) map[string]string {
+	ctx := map[string]string{}
+	for k, v := range params {
+		ctx[k] = v
+	}
+	ctx["vg"] = vg
+	return ctx
+}
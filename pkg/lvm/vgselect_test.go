@@ -0,0 +1,55 @@
+package lvm
+
+import "testing"
+
+func TestVGPolicies(t *testing.T) {
+	candidates := []vgCandidate{
+		{Name: "vg1", Free: 10 * GBSIZE},
+		{Name: "vg2", Free: 30 * GBSIZE},
+		{Name: "vg3", Free: 20 * GBSIZE},
+	}
+	if got := vgPolicies["mostFree"].Choose(candidates); got.Name != "vg2" {
+		t.Errorf("mostFree expect vg2, got %s", got.Name)
+	}
+	if got := vgPolicies["leastFree"].Choose(candidates); got.Name != "vg1" {
+		t.Errorf("leastFree expect vg1, got %s", got.Name)
+	}
+	rr := &roundRobinPolicy{}
+	for i, expect := range []string{"vg1", "vg2", "vg3", "vg1"} {
+		if got := rr.Choose(candidates); got.Name != expect {
+			t.Errorf("roundRobin round %d expect %s, got %s", i, expect, got.Name)
+		}
+	}
+}
+
+func TestHasAllTags(t *testing.T) {
+	if !hasAllTags("ssd,fast", []string{"ssd"}) {
+		t.Error("vg with tag ssd should match")
+	}
+	if hasAllTags("hdd", []string{"ssd"}) {
+		t.Error("vg without tag ssd should not match")
+	}
+	if !hasAllTags("", nil) {
+		t.Error("empty selector should match")
+	}
+}
+
+func TestVGFilter(t *testing.T) {
+	f := &vgFilter{include: []string{"vg*", "data"}, exclude: []string{"vgroot"}}
+	for vg, expect := range map[string]bool{
+		"vgdata": true,
+		"data":   true,
+		"vgroot": false,
+		"centos": false,
+	} {
+		if got := f.allowed(vg); got != expect {
+			t.Errorf("allowed(%s) expect %v, got %v", vg, expect, got)
+		}
+	}
+	if !(&vgFilter{}).allowed("anything") {
+		t.Error("empty filter should allow every vg")
+	}
+	if err := SetVGFilter(nil, []string{"["}); err == nil {
+		t.Error("invalid pattern should be rejected")
+	}
+}